@@ -0,0 +1,302 @@
+package compass
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResponseCache keeps the responses of a route in memory, so expensive
+// handlers don't run on every request.
+//
+// Only GET and HEAD requests are cached, and only 200 responses with a Body
+// that set no cookies and are not marked private or no-store. Requests
+// with a valid session always run the handler, so per-user content is
+// never shared. Concurrent misses for the same key wait for a single
+// handler call.
+//
+//	server.AddRoute("/stats", handleStats).ResponseCache = compass.NewResponseCache(time.Minute, 100)
+type ResponseCache struct {
+	// TTL is how long a response stays cached.
+	TTL time.Duration
+
+	// MaxEntries and MaxBytes bound the cache. The least recently used
+	// responses are evicted first. Zero means no limit.
+	MaxEntries int
+	MaxBytes   int
+
+	mutex      sync.Mutex
+	entries    map[string]*list.Element
+	lru        *list.List
+	varies     map[string][]string
+	inflight   map[string]*cacheFlight
+	size       int
+	generation uint64
+}
+
+// cacheEntry is a stored response.
+type cacheEntry struct {
+	key     string
+	resp    Response
+	expires time.Time
+}
+
+// cacheFlight is a handler call other requests for the same key wait for.
+type cacheFlight struct {
+	done chan struct{}
+}
+
+// NewResponseCache creates a ResponseCache with the given TTL and maximum
+// number of entries. A ResponseCache literal works as well.
+func NewResponseCache(ttl time.Duration, maxEntries int) *ResponseCache {
+	return &ResponseCache{TTL: ttl, MaxEntries: maxEntries}
+}
+
+// init creates the maps and list of a cache on first use, so the zero
+// value is usable. The cache's mutex must be held.
+func (c *ResponseCache) init() {
+	if c.entries != nil {
+		return
+	}
+
+	c.entries = make(map[string]*list.Element)
+	c.lru = list.New()
+	c.varies = make(map[string][]string)
+	c.inflight = make(map[string]*cacheFlight)
+}
+
+// handle answers the request from the cache, or runs the route's handler
+// and stores the response if possible.
+func (c *ResponseCache) handle(s *Server, r Request) Response {
+	if r.Http.Method != http.MethodGet && r.Http.Method != http.MethodHead {
+		return r.Route.handler(r)
+	}
+
+	if _, ok := r.GetSession(s); ok {
+		return r.Route.handler(r)
+	}
+
+	base := cacheBaseKey(r.Http.Method, r.Http.URL)
+
+	for attempt := 0; attempt < 2; attempt++ {
+		c.mutex.Lock()
+		c.init()
+		key := c.variantKey(base, r.Http.Header)
+
+		if resp, ok := c.lookup(key); ok {
+			c.mutex.Unlock()
+			return resp
+		}
+
+		if flight, ok := c.inflight[key]; ok && attempt == 0 {
+			c.mutex.Unlock()
+			<-flight.done
+			continue
+		}
+
+		flight := &cacheFlight{done: make(chan struct{})}
+		c.inflight[key] = flight
+		generation := c.generation
+		c.mutex.Unlock()
+
+		return c.lead(s, r, base, key, flight, generation)
+	}
+
+	return r.Route.handler(r)
+}
+
+// lead calls the handler for a flight and stores the response if it is
+// cacheable and the cache wasn't purged in the meantime. The flight is
+// ended even if the handler panics, so waiting requests are not stuck.
+//
+// A pending template is rendered first, so the stored response has the
+// body that is sent and its size counts against MaxBytes.
+func (c *ResponseCache) lead(s *Server, r Request, base string, key string, flight *cacheFlight, generation uint64) (resp Response) {
+	stored := false
+	defer func() {
+		c.mutex.Lock()
+		if stored && c.generation == generation {
+			c.store(base, r.Http.Header, resp)
+		}
+		if c.inflight[key] == flight {
+			delete(c.inflight, key)
+		}
+		c.mutex.Unlock()
+
+		close(flight.done)
+	}()
+
+	resp = r.Route.handler(r)
+	if err := s.renderTemplate(&r, &resp); err != nil {
+		return InternalError(fmt.Sprintf("failed to render template: %s", err))
+	}
+
+	stored = cacheable(r, resp)
+	return resp
+}
+
+// lookup returns a copy of the stored response for key if it hasn't
+// expired. The cache's mutex must be held.
+func (c *ResponseCache) lookup(key string) (Response, bool) {
+	element, ok := c.entries[key]
+	if !ok {
+		return Response{}, false
+	}
+
+	entry := element.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.remove(element)
+		return Response{}, false
+	}
+
+	c.lru.MoveToFront(element)
+
+	resp := entry.resp
+	resp.Headers = entry.resp.Headers.Clone()
+	return resp, true
+}
+
+// store adds a response and evicts the least recently used entries until
+// the cache is within its limits. The cache's mutex must be held.
+func (c *ResponseCache) store(base string, header http.Header, resp Response) {
+	c.varies[base] = varyHeaders(resp.Headers)
+	key := c.variantKey(base, header)
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	resp.Headers = resp.Headers.Clone()
+	entry := &cacheEntry{key: key, resp: resp, expires: time.Now().Add(c.TTL)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += len(resp.Body)
+
+	for c.lru.Len() > 0 && ((c.MaxEntries > 0 && c.lru.Len() > c.MaxEntries) || (c.MaxBytes > 0 && c.size > c.MaxBytes)) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an entry. The cache's mutex must be held.
+func (c *ResponseCache) remove(element *list.Element) {
+	entry := c.lru.Remove(element).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= len(entry.resp.Body)
+}
+
+// variantKey extends the base key with the request headers the response
+// varies by, as learned from the last stored response. The cache's mutex
+// must be held.
+func (c *ResponseCache) variantKey(base string, header http.Header) string {
+	names := c.varies[base]
+	if len(names) == 0 {
+		return base
+	}
+
+	var b strings.Builder
+	b.WriteString(base)
+	for _, name := range names {
+		b.WriteString("\n")
+		b.WriteString(name)
+		b.WriteString(":")
+		b.WriteString(strings.Join(header.Values(name), ","))
+	}
+
+	return b.String()
+}
+
+// Purge removes all stored responses. Handler calls that are running
+// while Purge is called don't store their result.
+func (c *ResponseCache) Purge() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.init()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+	c.varies = make(map[string][]string)
+	c.size = 0
+	c.generation++
+}
+
+// Len returns the number of stored responses, including expired ones that
+// have not been evicted yet.
+func (c *ResponseCache) Len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lru == nil {
+		return 0
+	}
+
+	return c.lru.Len()
+}
+
+// InvalidateCache purges the ResponseCache of the route with the given
+// Name. It returns false if there is no such route or it has no cache.
+func (s *Server) InvalidateCache(name string) bool {
+	route := s.FindRouteByName(name)
+	if route == nil || route.ResponseCache == nil {
+		return false
+	}
+
+	route.ResponseCache.Purge()
+	return true
+}
+
+// cacheBaseKey identifies a request by method, path and query. Query
+// parameters are sorted, so their order doesn't matter. HEAD has its own
+// entries, since a handler may leave out the body for it.
+func cacheBaseKey(method string, u *url.URL) string {
+	return method + " " + u.Path + "?" + u.Query().Encode()
+}
+
+// varyHeaders returns the canonical request header names listed in a
+// response's Vary header.
+func varyHeaders(headers http.Header) []string {
+	var names []string
+	for _, name := range splitHeaderList(headers.Values("Vary")) {
+		names = append(names, http.CanonicalHeaderKey(name))
+	}
+
+	return names
+}
+
+// cacheable reports whether a response may be stored and served to other
+// clients.
+func cacheable(r Request, resp Response) bool {
+	if resp.internalError || resp.StatusCode != http.StatusOK {
+		return false
+	}
+
+	// The size of an unrendered template is unknown, see lead.
+	if resp.template != nil {
+		return false
+	}
+
+	if len(resp.cookies) > 0 || resp.kind != KindPlain {
+		return false
+	}
+
+	// A CSRF token read by the handler may be in the body. It belongs to
+	// this client only.
+	if r.csrf != nil && r.csrf.token != "" {
+		return false
+	}
+
+	if headerHasToken(resp.Headers, "Vary", "*") {
+		return false
+	}
+
+	for _, value := range resp.Headers.Values("Cache-Control") {
+		value = strings.ToLower(value)
+		if strings.Contains(value, "no-store") || strings.Contains(value, "private") {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,158 @@
+package compass
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// fingerprintPattern matches file names with a content hash before the
+// extension, like "app.3f9a2c1b.js" or "index-B4x9kQ2m.css".
+var fingerprintPattern = regexp.MustCompile(`[.-]([A-Za-z0-9_]{8,})\.[A-Za-z0-9]+$`)
+
+// CachePolicy defines the Cache-Control header to attach to a response.
+//
+// Durations are in seconds. Fields left at their zero value are omitted.
+// Use CacheFingerprinted, CacheRevalidate or CacheNoStore for common cases.
+type CachePolicy struct {
+	Public         bool
+	Private        bool
+	NoCache        bool
+	NoStore        bool
+	MustRevalidate bool
+	Immutable      bool
+
+	MaxAge               int
+	SMaxAge              int
+	StaleWhileRevalidate int
+}
+
+// CacheFingerprinted returns a policy for assets whose URL changes with
+// their content, e.g. "app.3f9a2c1b.js". They can be cached by anyone for a
+// year without ever revalidating.
+func CacheFingerprinted() CachePolicy {
+	return CachePolicy{
+		Public:    true,
+		MaxAge:    365 * 24 * 60 * 60,
+		Immutable: true,
+	}
+}
+
+// CacheRevalidate returns a policy that lets anyone store a response but
+// requires checking with the server before every use. Combined with an
+// ETag or Last-Modified, unchanged content is answered with a 304.
+func CacheRevalidate() CachePolicy {
+	return CachePolicy{
+		Public:  true,
+		NoCache: true,
+	}
+}
+
+// CacheNoStore returns a policy that forbids storing the response at all,
+// for sensitive data.
+func CacheNoStore() CachePolicy {
+	return CachePolicy{NoStore: true}
+}
+
+// String returns the Cache-Control header value of the policy, or an empty
+// string for the zero value.
+//
+// NoStore overrides everything else, since the other directives describe
+// how to use a stored response.
+func (c CachePolicy) String() string {
+	if c.NoStore {
+		return "no-store"
+	}
+
+	var directives []string
+
+	if c.Public {
+		directives = append(directives, "public")
+	} else if c.Private {
+		directives = append(directives, "private")
+	}
+
+	if c.NoCache {
+		directives = append(directives, "no-cache")
+	}
+
+	if c.MaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("max-age=%d", c.MaxAge))
+	}
+
+	if c.SMaxAge > 0 {
+		directives = append(directives, fmt.Sprintf("s-maxage=%d", c.SMaxAge))
+	}
+
+	if c.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%d", c.StaleWhileRevalidate))
+	}
+
+	if c.MustRevalidate {
+		directives = append(directives, "must-revalidate")
+	}
+
+	if c.Immutable {
+		directives = append(directives, "immutable")
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// Apply sets the policy's Cache-Control header on the given Response and
+// returns it. An empty policy leaves the response unchanged.
+func (c CachePolicy) Apply(r Response) Response {
+	if value := c.String(); value != "" {
+		r.ensureHeaders()
+		r.Headers.Set("Cache-Control", value)
+	}
+
+	return r
+}
+
+// WithCache attaches the given CachePolicy to this response and returns it.
+//
+//	return compass.JsonMarshal(stats).WithCache(compass.CachePolicy{Public: true, MaxAge: 60})
+func (r Response) WithCache(policy CachePolicy) Response {
+	return policy.Apply(r)
+}
+
+// IsFingerprinted reports whether a file name contains a content hash
+// before its extension, e.g. "app.3f9a2c1b.js".
+//
+// The hash must be at least 8 characters long and contain a digit, so
+// names like "app-component.js" are not mistaken for fingerprints.
+func IsFingerprinted(name string) bool {
+	match := fingerprintPattern.FindStringSubmatch(path.Base(name))
+	if match == nil {
+		return false
+	}
+
+	return strings.ContainsAny(match[1], "0123456789")
+}
+
+// defaultStaticCache is the default Server.StaticCache. Fingerprinted files
+// are cached forever, everything else is revalidated on every use.
+func defaultStaticCache(name string) CachePolicy {
+	if IsFingerprinted(name) {
+		return CacheFingerprinted()
+	}
+
+	return CacheRevalidate()
+}
+
+// applyRouteCache attaches the route's CachePolicy to a response, unless
+// the handler set a Cache-Control header itself or the response is an error.
+func applyRouteCache(route *Route, resp Response) Response {
+	if route == nil || route.Cache == nil || resp.StatusCode >= http.StatusBadRequest {
+		return resp
+	}
+
+	if resp.Headers.Get("Cache-Control") != "" {
+		return resp
+	}
+
+	return route.Cache.Apply(resp)
+}
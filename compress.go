@@ -0,0 +1,422 @@
+package compass
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultCompressionTypes are the content types compressed when
+// ServerConfiguration.CompressionTypes is nil.
+//
+// Images, video, archives and fonts like woff2 are already compressed and
+// left out on purpose.
+var DefaultCompressionTypes = []string{
+	"text/*",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"application/xhtml+xml",
+	"application/rss+xml",
+	"application/atom+xml",
+	"application/ld+json",
+	"application/manifest+json",
+	"application/wasm",
+	"image/svg+xml",
+	"font/ttf",
+	"font/otf",
+}
+
+// Encoder is a content coding the server can compress responses with.
+//
+// Name is the token used in Accept-Encoding and Content-Encoding, e.g.
+// "gzip". NewWriter wraps w so that everything written to it is compressed.
+// Close is called once the response is complete. If the writer has a
+// Flush() error method, it is used when the response is flushed, e.g. for
+// streams.
+//
+// Other codings can be added without a dependency in Compass:
+//
+//	server.Encoders = append([]compass.Encoder{{
+//		Name: "zstd",
+//		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+//			return zstd.NewWriter(w)
+//		},
+//	}}, server.Encoders...)
+type Encoder struct {
+	Name      string
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// GzipEncoder returns an Encoder for gzip with the given compression level,
+// e.g. gzip.DefaultCompression. Writers are pooled.
+func GzipEncoder(level int) Encoder {
+	pool := &sync.Pool{}
+
+	return Encoder{
+		Name: "gzip",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			if gw, ok := pool.Get().(*gzip.Writer); ok {
+				gw.Reset(w)
+				return &pooledGzipWriter{Writer: gw, pool: pool}, nil
+			}
+
+			gw, err := gzip.NewWriterLevel(w, level)
+			if err != nil {
+				return nil, err
+			}
+
+			return &pooledGzipWriter{Writer: gw, pool: pool}, nil
+		},
+	}
+}
+
+// pooledGzipWriter returns its gzip.Writer to the pool when closed.
+type pooledGzipWriter struct {
+	*gzip.Writer
+	pool *sync.Pool
+}
+
+func (p *pooledGzipWriter) Close() error {
+	err := p.Writer.Close()
+	p.pool.Put(p.Writer)
+	return err
+}
+
+// DeflateEncoder returns an Encoder for deflate with the given compression
+// level, e.g. flate.DefaultCompression.
+//
+// HTTP's "deflate" is zlib-wrapped in theory, but browsers accept and
+// servers send raw deflate streams, so that is what is used here.
+func DeflateEncoder(level int) Encoder {
+	return Encoder{
+		Name: "deflate",
+		NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		},
+	}
+}
+
+// defaultEncoders returns the encoders of a new server, in order of
+// preference.
+func defaultEncoders() []Encoder {
+	return []Encoder{
+		GzipEncoder(gzip.DefaultCompression),
+		DeflateEncoder(flate.DefaultCompression),
+	}
+}
+
+// negotiateEncoding picks the encoder to use for an Accept-Encoding header,
+// or nil if the client accepts none of them.
+//
+// The encoder with the highest q-value wins. Ties go to the encoder listed
+// first. Codings the client doesn't mention are only acceptable through
+// "*".
+func negotiateEncoding(header string, encoders []Encoder) *Encoder {
+	if header == "" {
+		return nil
+	}
+
+	weights := make(map[string]float64)
+	for _, entry := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(entry, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "x-gzip" {
+			name = "gzip"
+		}
+
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+			if ok && strings.EqualFold(key, "q") {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+
+		if name != "" {
+			weights[name] = q
+		}
+	}
+
+	var best *Encoder
+	bestQ := 0.0
+	for i := range encoders {
+		q, ok := weights[strings.ToLower(encoders[i].Name)]
+		if !ok {
+			q, ok = weights["*"]
+		}
+
+		if ok && q > bestQ {
+			best = &encoders[i]
+			bestQ = q
+		}
+	}
+
+	return best
+}
+
+// compressWriter compresses a response on the fly if the client accepts
+// one of the server's encoders and the response qualifies.
+//
+// The decision needs the final headers and, if there is no Content-Length,
+// enough of the body to compare against CompressionMinSize. Until then the
+// status code is held back and the body buffered. Handlers, ServeContent and
+// streams all write through it unchanged.
+type compressWriter struct {
+	http.ResponseWriter
+	server  *Server
+	request *http.Request
+	encoder *Encoder
+
+	status   int
+	buffer   []byte
+	decided  bool
+	hijacked bool
+	writer   io.WriteCloser
+}
+
+// newCompressWriter wraps w for the given request. The returned writer
+// must be closed once the request is handled.
+func (s *Server) newCompressWriter(w http.ResponseWriter, r *http.Request) *compressWriter {
+	return &compressWriter{
+		ResponseWriter: w,
+		server:         s,
+		request:        r,
+		encoder:        negotiateEncoding(r.Header.Get("Accept-Encoding"), s.Encoders),
+	}
+}
+
+// WriteHeader holds back the status code until the compression decision is
+// made. Informational status codes are passed through.
+func (c *compressWriter) WriteHeader(code int) {
+	if c.decided || code < 200 {
+		c.ResponseWriter.WriteHeader(code)
+		return
+	}
+
+	if c.status != 0 {
+		return
+	}
+
+	c.status = code
+
+	if c.request.Method == http.MethodHead || !bodyAllowed(code) {
+		c.decide()
+		return
+	}
+
+	if length := c.Header().Get("Content-Length"); length != "" {
+		c.decide()
+	}
+}
+
+// Write buffers the body until CompressionMinSize bytes arrived, then
+// decides and writes everything through.
+func (c *compressWriter) Write(p []byte) (int, error) {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.decided {
+		c.buffer = append(c.buffer, p...)
+		if len(c.buffer) < c.server.Config.CompressionMinSize {
+			return len(p), nil
+		}
+
+		if err := c.decide(); err != nil {
+			return 0, err
+		}
+
+		return len(p), nil
+	}
+
+	if c.writer != nil {
+		return c.writer.Write(p)
+	}
+
+	return c.ResponseWriter.Write(p)
+}
+
+// decide chooses whether to compress, writes the status code and the
+// buffered body.
+func (c *compressWriter) decide() error {
+	c.decided = true
+	header := c.Header()
+
+	if c.varies() {
+		header.Add("Vary", "Accept-Encoding")
+
+		if c.shouldCompress() {
+			c.startCompression()
+		}
+	}
+
+	c.ResponseWriter.WriteHeader(c.status)
+
+	buffer := c.buffer
+	c.buffer = nil
+	if len(buffer) == 0 {
+		return nil
+	}
+
+	var err error
+	if c.writer != nil {
+		_, err = c.writer.Write(buffer)
+	} else {
+		_, err = c.ResponseWriter.Write(buffer)
+	}
+
+	return err
+}
+
+// startCompression creates the encoder's writer and adjusts the headers.
+// If the writer cannot be created, the response is sent uncompressed.
+func (c *compressWriter) startCompression() {
+	writer, err := c.encoder.NewWriter(c.ResponseWriter)
+	if err != nil {
+		c.server.Logger.Error(fmt.Sprintf("failed to create %s writer: %v", c.encoder.Name, err))
+		return
+	}
+
+	header := c.Header()
+	c.writer = writer
+	header.Set("Content-Encoding", c.encoder.Name)
+	header.Del("Content-Length")
+	header.Del("Accept-Ranges")
+
+	// The compressed body is a different representation, so a strong
+	// validator of the original must not be reused for it.
+	if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		header.Set("ETag", "W/"+etag)
+	}
+}
+
+// varies reports whether the response could be compressed for some client,
+// which means caches have to key it by Accept-Encoding.
+func (c *compressWriter) varies() bool {
+	header := c.Header()
+
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+
+	if c.status == http.StatusPartialContent || !bodyAllowed(c.status) {
+		return false
+	}
+
+	if headerHasToken(header, "Cache-Control", "no-transform") {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	types := c.server.Config.CompressionTypes
+	if types == nil {
+		types = DefaultCompressionTypes
+	}
+
+	return len(types) > 0 && mediaTypeAllowed(mediaType, types)
+}
+
+// shouldCompress reports whether this response is compressed for this
+// client. varies must already be true.
+func (c *compressWriter) shouldCompress() bool {
+	if c.encoder == nil || c.request.Method == http.MethodHead {
+		return false
+	}
+
+	if length := c.Header().Get("Content-Length"); length != "" {
+		n, err := strconv.Atoi(length)
+		return err == nil && n >= c.server.Config.CompressionMinSize
+	}
+
+	return len(c.buffer) >= c.server.Config.CompressionMinSize
+}
+
+// FlushError decides with what was buffered so far, so streams are not
+// held back, and flushes the compressor and the connection.
+func (c *compressWriter) FlushError() error {
+	if c.status == 0 {
+		c.WriteHeader(http.StatusOK)
+	}
+
+	if !c.decided {
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+
+	if flusher, ok := c.writer.(interface{ Flush() error }); ok {
+		if err := flusher.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return http.NewResponseController(c.ResponseWriter).Flush()
+}
+
+// Flush implements http.Flusher.
+func (c *compressWriter) Flush() {
+	c.FlushError()
+}
+
+// Hijack hands the connection to the caller. Nothing is written by the
+// compressWriter afterwards.
+func (c *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(c.ResponseWriter).Hijack()
+	if err == nil {
+		c.hijacked = true
+	}
+
+	return conn, rw, err
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (c *compressWriter) Unwrap() http.ResponseWriter {
+	return c.ResponseWriter
+}
+
+// close finishes the response. A body smaller than CompressionMinSize is
+// still buffered at this point and written uncompressed.
+func (c *compressWriter) close() error {
+	if c.hijacked {
+		return nil
+	}
+
+	if !c.decided && (c.status != 0 || len(c.buffer) > 0) {
+		if c.status == 0 {
+			c.status = http.StatusOK
+		}
+
+		if err := c.decide(); err != nil {
+			return err
+		}
+	}
+
+	if c.writer == nil {
+		return nil
+	}
+
+	writer := c.writer
+	c.writer = nil
+	return writer.Close()
+}
+
+// bodyAllowed reports whether a response with the given status code may
+// have a body.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
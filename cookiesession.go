@@ -0,0 +1,410 @@
+package compass
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// cookieChunkSize is the most of a sealed session that goes into one
+	// cookie. Browsers accept about 4096 bytes per cookie, including its
+	// name and attributes.
+	cookieChunkSize = 3800
+
+	// cookieMaxChunks is the most cookies a session is split into. Many
+	// servers and proxies reject requests with more than 8-32 KB of
+	// headers.
+	cookieMaxChunks = 8
+)
+
+// cookiePayload is what a cookie session is sealed as.
+type cookiePayload struct {
+	ID          string                     `json:"id"`
+	Data        map[string]json.RawMessage `json:"data"`
+	LastAccess  int64                      `json:"last_access"`
+	CreatedAt   int64                      `json:"created_at,omitempty"`
+	IdleTimeout int64                      `json:"idle_timeout,omitempty"`
+	MaxLifetime int64                      `json:"max_lifetime,omitempty"`
+}
+
+// cookieSessionStore is the SessionStore of a single cookie session. It
+// holds the record for the duration of a request and notes whether it
+// changed, so the response only carries a new cookie if needed.
+type cookieSessionStore struct {
+	mutex   sync.Mutex
+	id      string
+	record  SessionRecord
+	changed bool
+}
+
+// Load returns a copy of the record if id is the session's.
+func (c *cookieSessionStore) Load(id string) (SessionRecord, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if id != c.id {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+
+	return cloneRecord(c.record), nil
+}
+
+// Save replaces the record.
+func (c *cookieSessionStore) Save(id string, record SessionRecord) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.id = id
+	c.record = cloneRecord(record)
+	c.changed = true
+	return nil
+}
+
+// Delete forgets the session, which removes its cookies.
+func (c *cookieSessionStore) Delete(id string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if id == c.id {
+		c.id = ""
+		c.changed = true
+	}
+
+	return nil
+}
+
+// List returns the id of the session.
+func (c *cookieSessionStore) List() ([]string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.id == "" {
+		return nil, nil
+	}
+
+	return []string{c.id}, nil
+}
+
+// Touch updates the last access time of the record.
+func (c *cookieSessionStore) Touch(id string, lastAccess int64) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if id != c.id {
+		return ErrSessionNotFound
+	}
+
+	c.record.LastAccess = lastAccess
+	c.changed = true
+	return nil
+}
+
+// Rename changes the id of the session.
+func (c *cookieSessionStore) Rename(oldID string, newID string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if oldID != c.id {
+		return ErrSessionNotFound
+	}
+
+	c.id = newID
+	c.changed = true
+	return nil
+}
+
+// lastAccess returns the last access time of the record.
+func (c *cookieSessionStore) lastAccess() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.record.LastAccess
+}
+
+// take returns the record if it changed since the last call, or if force
+// is set. ok is false otherwise.
+func (c *cookieSessionStore) take(force bool) (id string, record SessionRecord, ok bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.changed && !force {
+		return "", SessionRecord{}, false
+	}
+
+	c.changed = false
+	return c.id, c.record, true
+}
+
+// sessionState is the session GetSession returned for a request. Like
+// csrfState, it is shared by all copies of the Request. For cookie
+// sessions, every GetSession returns the same Session and its changes end
+// up in the response. For other sessions, it is only used to refresh the
+// expiry of the cookie.
+type sessionState struct {
+	loaded  bool
+	session *Session
+	chunks  int // chunk cookies sent by the client, see sealSessionCookies
+}
+
+// newCookieSession creates a session that lives in a cookie instead of the
+// SessionStore. It is not added to the session registry.
+func (s *Server) newCookieSession(id uuid.UUID, record SessionRecord) *Session {
+	session := newSession(s, id)
+	session.cookieStore = &cookieSessionStore{id: id.String(), record: cloneRecord(record)}
+
+	// Can't fail, the store has the record under this id.
+	session.reload()
+	return session
+}
+
+// cookieSession returns the session sealed into the request's cookies.
+//
+// The cookies are opened on the first call only. Later calls return the
+// same Session.
+func (r *Request) cookieSession(server *Server) (*Session, bool) {
+	state := r.session
+	if state == nil {
+		state = &sessionState{}
+	}
+
+	if !state.loaded {
+		state.session, state.chunks = server.openSessionCookies(r)
+		state.loaded = true
+	}
+
+	if state.session == nil || state.session.IsDestroyed() {
+		return nil, false
+	}
+
+	return state.session, true
+}
+
+// chunkCookieName returns the name of the i-th chunk cookie of a session.
+func chunkCookieName(i int) string {
+	return sessionCookieName + "." + strconv.Itoa(i)
+}
+
+// openSessionCookies reads the cookie session of a request. It returns the
+// number of chunk cookies the client sent, even if the session can't be
+// opened, so they can be removed.
+//
+// Sessions that fail to open, e.g. because the keys were rotated or the
+// cookie was changed, are treated as no session. Expired sessions are
+// returned destroyed, so their cookies are removed.
+func (s *Server) openSessionCookies(r *Request) (*Session, int) {
+	value, ok := r.GetCookie(sessionCookieName)
+	if !ok {
+		return nil, 0
+	}
+
+	// A sealed session is far longer than any chunk count, so a number
+	// means the session is split into that many chunk cookies.
+	chunks := 0
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 1 || n > cookieMaxChunks {
+			return nil, 0
+		}
+
+		chunks = n
+		var b strings.Builder
+		for i := range n {
+			part, ok := r.GetCookie(chunkCookieName(i))
+			if !ok {
+				return nil, chunks
+			}
+			b.WriteString(part)
+		}
+		value = b.String()
+	}
+
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, chunks
+	}
+
+	plaintext, rotated, err := s.SessionCookieKeys.open(sealed, []byte(sessionCookieName))
+	if err != nil {
+		return nil, chunks
+	}
+
+	var payload cookiePayload
+	if err = json.Unmarshal(plaintext, &payload); err != nil {
+		return nil, chunks
+	}
+
+	id, err := uuid.Parse(payload.ID)
+	if err != nil {
+		return nil, chunks
+	}
+
+	session := s.newCookieSession(id, SessionRecord{
+		Data:        payload.Data,
+		LastAccess:  payload.LastAccess,
+		CreatedAt:   payload.CreatedAt,
+		IdleTimeout: payload.IdleTimeout,
+		MaxLifetime: payload.MaxLifetime,
+	})
+
+	// Sessions sealed with an old key are sealed again with the current
+	// one, so the old key can be dropped eventually.
+	session.cookieStore.changed = rotated
+
+	// The destroyed session is kept, so the response removes its cookies.
+	if reason, ok := session.expiry(time.Now().UnixMilli()); ok {
+		s.OnSessionExpired(session, reason)
+		session.mustDestroy(reason)
+	}
+
+	return session, chunks
+}
+
+// sealSessionCookies seals a session into the values of the _compassId
+// cookie and its chunk cookies. A session that fits into one cookie is
+// sealed into _compassId directly. A larger one is split into chunk
+// cookies _compassId.0, _compassId.1, ... and _compassId holds their count.
+func (s *Server) sealSessionCookies(id string, record SessionRecord) ([]string, error) {
+	plaintext, err := json.Marshal(cookiePayload{
+		ID:          id,
+		Data:        record.Data,
+		LastAccess:  record.LastAccess,
+		CreatedAt:   record.CreatedAt,
+		IdleTimeout: record.IdleTimeout,
+		MaxLifetime: record.MaxLifetime,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session %s: %w", id, err)
+	}
+
+	sealed, err := s.SessionCookieKeys.seal(plaintext, []byte(sessionCookieName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to seal session %s: %w", id, err)
+	}
+
+	value := base64.RawURLEncoding.EncodeToString(sealed)
+	if len(value) <= cookieChunkSize {
+		return []string{value}, nil
+	}
+
+	var chunks []string
+	for len(value) > 0 {
+		n := min(cookieChunkSize, len(value))
+		chunks = append(chunks, value[:n])
+		value = value[n:]
+	}
+
+	if len(chunks) > cookieMaxChunks {
+		return nil, fmt.Errorf("session %s is too large for cookies (%d chunks, at most %d)", id, len(chunks), cookieMaxChunks)
+	}
+
+	return chunks, nil
+}
+
+// attachSessionCookies writes the cookie session of a request into the
+// response's cookies. That is the session passed to Response.SetSession,
+// or else the one GetSession returned.
+//
+// The cookies are only sent if the session changed during the request, if
+// it was set with SetSession, or if its last access is more than a
+// SessionTickInterval newer than the sealed one, which is when the
+// session reaper would write it to a SessionStore. The cookies of a
+// destroyed session are removed.
+//
+// For other sessions, the id cookie is sent again once per
+// SessionTickInterval, so its expiry follows the session's.
+func (s *Server) attachSessionCookies(r *Request, resp *Response) error {
+	state := r.session
+	if state == nil {
+		state = &sessionState{}
+	}
+
+	session, force := resp.session, resp.session != nil
+	if session == nil {
+		session = state.session
+	}
+
+	if session == nil {
+		return nil
+	}
+
+	now := time.Now().UnixMilli()
+	if session.cookieStore == nil {
+		if !session.IsDestroyed() && now-session.cookieSent.Load() >= int64(s.Config.SessionTickInterval) {
+			resp.SetCookie(session.cookie())
+		}
+
+		return nil
+	}
+
+	resp.session = nil
+
+	if !session.IsDestroyed() && session.LastAccess()-session.cookieStore.lastAccess() >= int64(s.Config.SessionTickInterval) {
+		if err := session.touch(); err != nil {
+			return err
+		}
+	}
+
+	id, record, ok := session.cookieStore.take(force)
+	if !ok {
+		return nil
+	}
+
+	if id == "" || record.Destroyed {
+		resp.RemoveCookie(sessionCookieName)
+		for i := range state.chunks {
+			resp.RemoveCookie(chunkCookieName(i))
+		}
+
+		state.chunks = 0
+		return nil
+	}
+
+	values, err := s.sealSessionCookies(id, record)
+	if err != nil {
+		return err
+	}
+
+	chunks := 0
+	if len(values) == 1 {
+		resp.SetCookie(r.sessionCookie(session, sessionCookieName, values[0]))
+	} else {
+		chunks = len(values)
+		resp.SetCookie(r.sessionCookie(session, sessionCookieName, strconv.Itoa(chunks)))
+		for i, value := range values {
+			resp.SetCookie(r.sessionCookie(session, chunkCookieName(i), value))
+		}
+	}
+
+	// Chunks the client has from a larger session would otherwise stay
+	// around until the browser is closed.
+	for i := chunks; i < state.chunks; i++ {
+		resp.RemoveCookie(chunkCookieName(i))
+	}
+
+	state.chunks = chunks
+	return nil
+}
+
+// sessionCookie returns a cookie carrying (part of) a cookie session. It
+// is only sent over HTTPS if the request came in over HTTPS.
+func (r *Request) sessionCookie(session *Session, name string, value string) Cookie {
+	now := time.Now().UnixMilli()
+	maxAge, expires := session.cookieExpiry(now)
+	session.cookieSent.Store(now)
+
+	return Cookie{
+		Name:     name,
+		Value:    value,
+		MaxAge:   maxAge,
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.Scheme() == "https",
+		SameSite: SameSiteLax,
+		Path:     "/",
+	}
+}
@@ -0,0 +1,222 @@
+package compass
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// newCookieSessionTestServer returns a server with cookie sessions sealed
+// by keys.
+func newCookieSessionTestServer(keys *KeyRing) *Server {
+	server := NewServer(NewStandardConfiguration())
+	server.SessionCookieKeys = keys
+	return server
+}
+
+// requestWithCookies returns a Request carrying the cookies.
+func requestWithCookies(server *Server, cookies map[string]string) *Request {
+	httpRequest := httptest.NewRequest(http.MethodGet, "/", nil)
+	for name, value := range cookies {
+		httpRequest.AddCookie(&http.Cookie{Name: name, Value: value})
+	}
+
+	request := NewRequestFromHttp(httpRequest)
+	request.server = server
+	return &request
+}
+
+// sessionCookies creates a cookie session holding value under "v" and
+// returns the cookies a response would set for it.
+func sessionCookies(t *testing.T, server *Server, value string) map[string]string {
+	t.Helper()
+
+	session, err := server.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := session.BeginTx()
+	if err = tx.Set("v", value); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := Text("ok")
+	resp.SetSession(session)
+	if err = server.attachSessionCookies(requestWithCookies(server, nil), &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	cookies := make(map[string]string)
+	for _, cookie := range resp.Cookies() {
+		cookies[cookie.Name] = cookie.Value
+	}
+
+	return cookies
+}
+
+// largeSessionValue returns a value that doesn't compress and needs
+// several chunk cookies.
+func largeSessionValue(t *testing.T) string {
+	t.Helper()
+
+	b := make([]byte, 2*cookieChunkSize)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// openedValue returns the value under "v" of the cookie session of the
+// cookies, or false if it can't be opened.
+func openedValue(t *testing.T, server *Server, cookies map[string]string) (string, bool) {
+	t.Helper()
+
+	session, ok := requestWithCookies(server, cookies).GetSession(server)
+	if !ok {
+		return "", false
+	}
+
+	value, err := SessionGet[string](session, "v")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return value, true
+}
+
+func TestCookieSessionRoundTrip(t *testing.T) {
+	server := newCookieSessionTestServer(newTestKeyRing(t, newTestSecret(t)))
+
+	cookies := sessionCookies(t, server, "small")
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies, want 1", len(cookies))
+	}
+
+	if value, ok := openedValue(t, server, cookies); !ok || value != "small" {
+		t.Fatalf("opened %q, %v, want %q", value, ok, "small")
+	}
+}
+
+func TestCookieSessionChunks(t *testing.T) {
+	server := newCookieSessionTestServer(newTestKeyRing(t, newTestSecret(t)))
+	large := largeSessionValue(t)
+
+	cookies := sessionCookies(t, server, large)
+	chunks, err := strconv.Atoi(cookies[sessionCookieName])
+	if err != nil || chunks < 3 || len(cookies) != chunks+1 {
+		t.Fatalf("got %d cookies with a count of %q, want a count and at least 3 chunks", len(cookies), cookies[sessionCookieName])
+	}
+
+	if value, ok := openedValue(t, server, cookies); !ok || value != large {
+		t.Fatalf("opened the session: %v, value matches: %v", ok, value == large)
+	}
+}
+
+func TestCookieSessionRejectsBrokenChunks(t *testing.T) {
+	server := newCookieSessionTestServer(newTestKeyRing(t, newTestSecret(t)))
+	cookies := sessionCookies(t, server, largeSessionValue(t))
+
+	tests := map[string]func(cookies map[string]string){
+		"tampered": func(cookies map[string]string) {
+			chunk := []byte(cookies[chunkCookieName(1)])
+			chunk[10] ^= 0x01
+			cookies[chunkCookieName(1)] = string(chunk)
+		},
+		"truncated": func(cookies map[string]string) {
+			last := chunkCookieName(len(cookies) - 2)
+			cookies[last] = cookies[last][:len(cookies[last])-1]
+		},
+		"reordered": func(cookies map[string]string) {
+			first, second := chunkCookieName(0), chunkCookieName(1)
+			cookies[first], cookies[second] = cookies[second], cookies[first]
+		},
+		"missing": func(cookies map[string]string) {
+			delete(cookies, chunkCookieName(1))
+		},
+		"fewer counted": func(cookies map[string]string) {
+			cookies[sessionCookieName] = strconv.Itoa(len(cookies) - 2)
+		},
+		"zero count": func(cookies map[string]string) {
+			cookies[sessionCookieName] = "0"
+		},
+		"too many counted": func(cookies map[string]string) {
+			cookies[sessionCookieName] = strconv.Itoa(cookieMaxChunks + 1)
+		},
+	}
+
+	for name, change := range tests {
+		t.Run(name, func(t *testing.T) {
+			broken := make(map[string]string, len(cookies))
+			for key, value := range cookies {
+				broken[key] = value
+			}
+			change(broken)
+
+			if _, ok := openedValue(t, server, broken); ok {
+				t.Fatal("opened a broken session")
+			}
+		})
+	}
+}
+
+func TestCookieSessionRejectsTamperedValue(t *testing.T) {
+	server := newCookieSessionTestServer(newTestKeyRing(t, newTestSecret(t)))
+	cookies := sessionCookies(t, server, "small")
+
+	value := []byte(cookies[sessionCookieName])
+	value[len(value)/2] ^= 0x01
+	cookies[sessionCookieName] = string(value)
+
+	if _, ok := openedValue(t, server, cookies); ok {
+		t.Fatal("opened a tampered session")
+	}
+}
+
+func TestCookieSessionKeyRotation(t *testing.T) {
+	oldSecret, newSecret := newTestSecret(t), newTestSecret(t)
+
+	cookies := sessionCookies(t, newCookieSessionTestServer(newTestKeyRing(t, oldSecret)), "kept")
+
+	server := newCookieSessionTestServer(newTestKeyRing(t, newSecret, oldSecret))
+	request := requestWithCookies(server, cookies)
+
+	session, ok := request.GetSession(server)
+	if !ok {
+		t.Fatal("session sealed with the old key wasn't accepted")
+	}
+
+	// It is sealed again with the new key on the way out, even though
+	// nothing changed.
+	resp := Text("ok")
+	if err := server.attachSessionCookies(request, &resp); err != nil {
+		t.Fatal(err)
+	}
+
+	resealed := make(map[string]string)
+	for _, cookie := range resp.Cookies() {
+		resealed[cookie.Name] = cookie.Value
+	}
+
+	if len(resealed) == 0 {
+		t.Fatalf("session %s wasn't sealed again", session.ID())
+	}
+
+	current := newCookieSessionTestServer(newTestKeyRing(t, newSecret))
+	if value, ok := openedValue(t, current, resealed); !ok || value != "kept" {
+		t.Fatalf("opened %q, %v with the new key only, want %q", value, ok, "kept")
+	}
+
+	old := newCookieSessionTestServer(newTestKeyRing(t, oldSecret))
+	if _, ok := openedValue(t, old, resealed); ok {
+		t.Fatal("the old key opened a session sealed after the rotation")
+	}
+}
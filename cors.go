@@ -34,23 +34,23 @@ func AllowAll() CORSPolicy {
 // and returns it.
 func (c CORSPolicy) Apply(r Response) Response {
 	if c.Origin != "" {
-		r.Headers["Access-Control-Allow-Origin"] = c.Origin
+		r.Headers.Set("Access-Control-Allow-Origin", c.Origin)
 	}
 
 	if len(c.Methods) > 0 {
-		r.Headers["Access-Control-Allow-Methods"] = strings.Join(c.Methods, ", ")
+		r.Headers.Set("Access-Control-Allow-Methods", strings.Join(c.Methods, ", "))
 	}
 
 	if len(c.Headers) > 0 {
-		r.Headers["Access-Control-Allow-Headers"] = strings.Join(c.Headers, ", ")
+		r.Headers.Set("Access-Control-Allow-Headers", strings.Join(c.Headers, ", "))
 	}
 
 	if c.Credentials {
-		r.Headers["Access-Control-Allow-Credentials"] = "true"
+		r.Headers.Set("Access-Control-Allow-Credentials", "true")
 	}
 
 	if c.MaxAge > 0 {
-		r.Headers["Access-Control-Max-Age"] = fmt.Sprintf("%d", c.MaxAge)
+		r.Headers.Set("Access-Control-Max-Age", fmt.Sprintf("%d", c.MaxAge))
 	}
 
 	return r
@@ -0,0 +1,94 @@
+package compass
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"slices"
+)
+
+// csrfCookieName is the cookie holding the CSRF token of a client.
+const csrfCookieName = "_compassCsrf"
+
+// CSRFFieldName is the form field VerifyCSRF reads the token from.
+const CSRFFieldName = "_csrf"
+
+// CSRFHeaderName is the header VerifyCSRF reads the token from if the form
+// field is not present, for requests made from JavaScript.
+const CSRFHeaderName = "X-CSRF-Token"
+
+// csrfState remembers the CSRF token of a request, so that a token
+// generated in a handler is the same one used while rendering and set as
+// a cookie afterwards.
+type csrfState struct {
+	token string
+	fresh bool
+}
+
+// CSRFToken returns the CSRF token of the client.
+//
+// If the client has no token yet, a new one is generated and the
+// _compassCsrf cookie is set on the response automatically. Embed the token
+// in forms as CSRFFieldName, or send it as CSRFHeaderName, and check it
+// with VerifyCSRF.
+func (r *Request) CSRFToken() string {
+	if r.csrf == nil {
+		r.csrf = &csrfState{}
+	}
+
+	if r.csrf.token != "" {
+		return r.csrf.token
+	}
+
+	if token, ok := r.GetCookie(csrfCookieName); ok && token != "" {
+		r.csrf.token = token
+		return token
+	}
+
+	b := make([]byte, 32)
+	rand.Read(b)
+
+	r.csrf.token = base64.RawURLEncoding.EncodeToString(b)
+	r.csrf.fresh = true
+	return r.csrf.token
+}
+
+// VerifyCSRF reports whether the request carries the client's CSRF token,
+// either in the CSRFFieldName form field or the CSRFHeaderName header.
+//
+// Requests with a safe method (GET, HEAD, OPTIONS) always pass.
+func (r *Request) VerifyCSRF() bool {
+	if slices.Contains([]string{"get", "head", "options"}, r.Method) {
+		return true
+	}
+
+	expected, ok := r.GetCookie(csrfCookieName)
+	if !ok || expected == "" {
+		return false
+	}
+
+	actual := r.Http.Header.Get(CSRFHeaderName)
+	if actual == "" {
+		actual = r.Http.PostFormValue(CSRFFieldName)
+	}
+
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(actual)) == 1
+}
+
+// attachCSRFCookie sets the _compassCsrf cookie on the response if a new
+// token was generated during this request.
+func (r *Request) attachCSRFCookie(resp *Response) {
+	if r.csrf == nil || !r.csrf.fresh {
+		return
+	}
+
+	resp.SetCookie(Cookie{
+		Name:     csrfCookieName,
+		Value:    r.csrf.token,
+		HttpOnly: true,
+		Secure:   r.Scheme() == "https",
+		SameSite: SameSiteLax,
+		Path:     "/",
+	})
+	r.csrf.fresh = false
+}
@@ -0,0 +1,243 @@
+package compass
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ETag modes for ServerConfiguration.ETags.
+const (
+	ETagsOff    = ""
+	ETagsStrong = "strong"
+	ETagsWeak   = "weak"
+)
+
+// GenerateETag computes an entity tag for a body.
+//
+// A strong tag is a SHA-256 digest and changes with every byte. A weak tag
+// is a cheaper FNV digest combined with the length, marked with "W/". It
+// only claims the content is equivalent, which is enough for If-None-Match.
+func GenerateETag(body []byte, weak bool) string {
+	if weak {
+		h := fnv.New64a()
+		h.Write(body)
+		return fmt.Sprintf(`W/"%x-%x"`, len(body), h.Sum64())
+	}
+
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// WithETag sets the ETag header of the response. The tag is quoted if it
+// isn't already.
+//
+//	return compass.JsonMarshal(item).WithETag(item.Version, false)
+func (r Response) WithETag(tag string, weak bool) Response {
+	tag = strings.TrimPrefix(tag, "W/")
+	if !strings.HasPrefix(tag, `"`) {
+		tag = `"` + tag + `"`
+	}
+
+	if weak {
+		tag = "W/" + tag
+	}
+
+	r.ensureHeaders()
+	r.Headers.Set("ETag", tag)
+	return r
+}
+
+// WithLastModified sets the Last-Modified header of the response, which
+// lets clients revalidate with If-Modified-Since.
+//
+// For responses built with ServeContent or ServeFile, it replaces the
+// modification time used by http.ServeContent.
+//
+//	return compass.JsonMarshal(post).WithLastModified(post.UpdatedAt)
+func (r Response) WithLastModified(t time.Time) Response {
+	r.ensureHeaders()
+	r.Headers.Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+	if r.serve != nil {
+		r.serve.modTime = t
+	}
+
+	return r
+}
+
+// CheckPreconditions evaluates If-Match, If-Unmodified-Since, If-None-Match
+// and If-Modified-Since against the current ETag and modification time of
+// a resource. Either may be empty or zero if unknown.
+//
+// If a precondition fails, the 304 or 412 response to return is given with
+// true. Compass does this automatically for GET and HEAD responses, but a
+// handler changing a resource must check before it makes the change:
+//
+//	if resp, failed := r.CheckPreconditions(doc.ETag, doc.UpdatedAt); failed {
+//		return resp
+//	}
+func (r *Request) CheckPreconditions(etag string, lastModified time.Time) (Response, bool) {
+	status := evaluatePreconditions(r.Http, etag, lastModified)
+	if status == 0 {
+		return Response{}, false
+	}
+
+	if status == http.StatusNotModified {
+		return notModified(Raw(nil, nil, http.StatusOK), etag, lastModified), true
+	}
+
+	return TextWithCode("Precondition Failed", status), true
+}
+
+// evaluatePreconditions applies the conditional request headers in the
+// order of RFC 9110, section 13.2.2. It returns 304, 412, or 0 if the
+// request should proceed.
+func evaluatePreconditions(r *http.Request, etag string, lastModified time.Time) int {
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	if header := r.Header.Get("If-Match"); header != "" {
+		if !etagListMatches(header, etag, false) {
+			return http.StatusPreconditionFailed
+		}
+	} else if since, ok := parseHTTPDate(r.Header.Get("If-Unmodified-Since")); ok && !lastModified.IsZero() {
+		if lastModified.Truncate(time.Second).After(since) {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		if etagListMatches(header, etag, true) {
+			if safe {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if since, ok := parseHTTPDate(r.Header.Get("If-Modified-Since")); ok && safe && !lastModified.IsZero() {
+		if !lastModified.Truncate(time.Second).After(since) {
+			return http.StatusNotModified
+		}
+	}
+
+	return 0
+}
+
+// etagListMatches reports whether a comma-separated If-Match or
+// If-None-Match value contains etag. "*" matches any existing resource.
+//
+// Weak comparison ignores the "W/" prefix. Strong comparison never matches
+// weak tags.
+func etagListMatches(header string, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+			continue
+		}
+
+		if !strings.HasPrefix(candidate, "W/") && !strings.HasPrefix(etag, "W/") && candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseHTTPDate parses a date header. The second return value is false if
+// the header is empty or malformed, in which case it must be ignored.
+func parseHTTPDate(value string) (time.Time, bool) {
+	if value == "" {
+		return time.Time{}, false
+	}
+
+	t, err := http.ParseTime(value)
+	return t, err == nil
+}
+
+// notModified turns a response into a 304. Cookies and headers are kept,
+// since a 304 must carry the same validators and caching headers as the
+// full response would have. The body and its headers are dropped.
+func notModified(resp Response, etag string, lastModified time.Time) Response {
+	resp.discard()
+
+	headers := resp.Headers.Clone()
+	if headers == nil {
+		headers = make(http.Header)
+	}
+
+	for _, key := range []string{"Content-Length", "Content-Type", "Content-Encoding", "Content-Disposition"} {
+		headers.Del(key)
+	}
+
+	if etag != "" {
+		headers.Set("ETag", etag)
+	}
+
+	if !lastModified.IsZero() {
+		headers.Set("Last-Modified", lastModified.UTC().Format(http.TimeFormat))
+	}
+
+	resp.Headers = headers
+	resp.StatusCode = http.StatusNotModified
+	resp.kind = KindPlain
+	resp.Body = nil
+	resp.stream = nil
+	resp.serve = nil
+	return resp
+}
+
+// applyConditional adds an automatic ETag to a GET or HEAD response if the
+// server is configured for it, and answers the request with a 304 or 412
+// if its preconditions fail.
+//
+// Only successful plain and stream responses are considered. Streams are
+// never hashed, but are still checked if the handler set an ETag or
+// Last-Modified itself. Serve responses are checked by http.ServeContent.
+func (s *Server) applyConditional(r Request, resp Response) Response {
+	if r.Http.Method != http.MethodGet && r.Http.Method != http.MethodHead {
+		return resp
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return resp
+	}
+
+	if resp.kind != KindPlain && resp.kind != KindStream {
+		return resp
+	}
+
+	etag := resp.Headers.Get("ETag")
+	if etag == "" && resp.kind == KindPlain && s.Config.ETags != ETagsOff {
+		etag = GenerateETag(resp.Body, s.Config.ETags == ETagsWeak)
+		resp.ensureHeaders()
+		resp.Headers.Set("ETag", etag)
+	}
+
+	lastModified, _ := parseHTTPDate(resp.Headers.Get("Last-Modified"))
+
+	switch evaluatePreconditions(r.Http, etag, lastModified) {
+	case http.StatusNotModified:
+		return notModified(resp, etag, lastModified)
+	case http.StatusPreconditionFailed:
+		resp.discard()
+		failed := TextWithCode("Precondition Failed", http.StatusPreconditionFailed)
+		failed.cookies = resp.cookies
+		return failed
+	}
+
+	return resp
+}
@@ -0,0 +1,49 @@
+package compass
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWithETagOnLiteralResponse(t *testing.T) {
+	resp := Response{StatusCode: http.StatusOK}.WithETag("v1", true)
+
+	if got := resp.Headers.Get("ETag"); got != `W/"v1"` {
+		t.Fatalf("ETag = %q, want %q", got, `W/"v1"`)
+	}
+}
+
+func TestWithLastModifiedOnLiteralResponse(t *testing.T) {
+	modified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	resp := Response{StatusCode: http.StatusOK}.WithLastModified(modified)
+
+	if got := resp.Headers.Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+		t.Fatalf("Last-Modified = %q, want %q", got, modified.Format(http.TimeFormat))
+	}
+}
+
+func TestApplyConditionalOnLiteralResponse(t *testing.T) {
+	config := NewStandardConfiguration()
+	config.ETags = ETagsStrong
+	server := NewServer(config)
+
+	body := []byte("hello")
+	request := NewRequestFromHttp(httptest.NewRequest(http.MethodGet, "/", nil))
+
+	resp := server.applyConditional(request, Response{StatusCode: http.StatusOK, Body: body})
+	etag := resp.Headers.Get("ETag")
+	if etag != GenerateETag(body, false) {
+		t.Fatalf("ETag = %q, want %q", etag, GenerateETag(body, false))
+	}
+
+	httpRequest := httptest.NewRequest(http.MethodGet, "/", nil)
+	httpRequest.Header.Set("If-None-Match", etag)
+	request = NewRequestFromHttp(httpRequest)
+
+	resp = server.applyConditional(request, Response{StatusCode: http.StatusOK, Body: body})
+	if resp.StatusCode != http.StatusNotModified {
+		t.Fatalf("StatusCode = %d, want %d", resp.StatusCode, http.StatusNotModified)
+	}
+}
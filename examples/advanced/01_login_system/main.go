@@ -16,20 +16,17 @@ type User struct {
 var users = make(map[string]User)
 
 func main() {
-	server = compass.NewServer(compass.NewStandardConfiguration())
+	config := compass.NewStandardConfiguration()
+	config.DevMode = true // reload templates when they change
+	server = compass.NewServer(config)
 
 	//
 	// Page that changes its content based on whether you are logged in or not
 	//
 	server.AddRoute("/", func(request compass.Request) compass.Response {
-		session, ok := request.GetSession(server)
+		session, id, ok := loggedIn(request)
 		if !ok {
-			return compass.ServeFile("index.html", "index.html")
-		}
-
-		id, err := compass.SessionGet[string](session, "name")
-		if err != nil {
-			return compass.InternalError("corrupted session, is missing name")
+			return compass.Render("index.html", nil)
 		}
 
 		user, ok := users[id]
@@ -38,19 +35,19 @@ func main() {
 			return compass.Text("Your session contains weird data. Try again")
 		}
 
-		return compass.HTML(fmt.Sprintf("<html><p>You are logged in as %s; password %s. <a href=\"/logout\">Log out.</a></html>", user.Name, user.Password))
-	})
+		return compass.Render("home.html", user)
+	}).Name = "home"
 
 	//
 	// Separate page that is only available to logged in people
 	//
 	server.AddRoute("/special", func(request compass.Request) compass.Response {
-		session, ok := request.GetSession(server)
+		_, name, ok := loggedIn(request)
 		if !ok {
 			return compass.Redirect("/", false)
 		}
 
-		return compass.Text(fmt.Sprintf("Hi %s!", compass.SessionGetOrDefault[string](session, "name", "fallback")))
+		return compass.Text(fmt.Sprintf("Hi %s!", name))
 	})
 
 	//
@@ -58,14 +55,18 @@ func main() {
 	//
 	routeLogin := server.AddRoute("/login", func(request compass.Request) compass.Response {
 		// if already logged in, do not allow new login
-		_, ok := request.GetSession(server)
+		_, _, ok := loggedIn(request)
 		if ok {
 			return compass.Redirect("/", false)
 		}
 
 		if request.Method == "get" {
-			return compass.ServeFile("login.html", "login.html")
+			return compass.Render("login.html", nil)
 		} else if request.Method == "post" {
+			if !request.VerifyCSRF() {
+				return compass.TextWithCode("Invalid CSRF token, please reload the page", 403)
+			}
+
 			err := request.Http.ParseForm()
 			if err != nil {
 				return compass.InternalError(fmt.Sprintf("failed to parse form: %s", err))
@@ -77,9 +78,9 @@ func main() {
 
 			switch action {
 			case "Login":
-				return handleLogin(username, password)
+				return handleLogin(request, username, password)
 			case "Register":
-				return handleRegister(username, password)
+				return handleRegister(request, username, password)
 			default:
 				return compass.Text("Invalid action")
 			}
@@ -88,6 +89,7 @@ func main() {
 		return compass.InternalError("somehow triggered illegal method")
 	})
 	routeLogin.AllowedMethods = append(routeLogin.AllowedMethods, "post")
+	routeLogin.Name = "login"
 
 	//
 	// Route that logs you out
@@ -100,62 +102,92 @@ func main() {
 
 		session.MustDestroy()
 		return compass.Redirect("/", false)
-	})
+	}).Name = "logout"
 
 	server.MustRun()
 }
 
-func handleRegister(username string, password string) compass.Response {
-	_, ok := users[username]
-	if ok {
-		return compass.Text("User with same name is already registered!")
+// loggedIn returns the session of the request and the name of its user, if
+// someone is logged in. A session without a name only carries flashes.
+func loggedIn(request compass.Request) (*compass.Session, string, bool) {
+	session, ok := request.GetSession(server)
+	if !ok {
+		return nil, "", false
 	}
 
-	users[username] = User{
-		Name:     username,
-		Password: password,
+	name, err := compass.SessionGet[string](session, "name")
+	if err != nil {
+		return nil, "", false
 	}
 
-	session, err := makeSession(username)
-	if err != nil {
-		return *err
+	return session, name, true
+}
+
+// loginError sends the user back to the login page, which shows the message
+// once. The flash needs a session, so one is created if there is none yet.
+func loginError(request compass.Request, message string) compass.Response {
+	session, ok := request.GetSession(server)
+	if !ok {
+		var err error
+		if session, err = server.CreateSession(); err != nil {
+			return compass.InternalError(err.Error())
+		}
 	}
 
-	resp := compass.Redirect("/", false)
+	if err := session.Flash("error", message); err != nil {
+		return compass.InternalError(err.Error())
+	}
+
+	resp := compass.Redirect("/login", false)
 	resp.SetSession(session)
 	return resp
 }
 
-func handleLogin(username string, password string) compass.Response {
-	user, ok := users[username]
-	if !ok {
-		return compass.Text("Username or password incorrect")
+func handleRegister(request compass.Request, username string, password string) compass.Response {
+	_, ok := users[username]
+	if ok {
+		return loginError(request, "User with same name is already registered!")
 	}
 
-	if user.Password != password {
-		return compass.Text("Username or password incorrect")
+	users[username] = User{
+		Name:     username,
+		Password: password,
 	}
 
-	session, err := makeSession(username)
-	if err != nil {
-		return *err
+	return logIn(request, username)
+}
+
+func handleLogin(request compass.Request, username string, password string) compass.Response {
+	user, ok := users[username]
+	if !ok || user.Password != password {
+		return loginError(request, "Username or password incorrect")
 	}
 
-	resp := compass.Redirect("/", false)
-	resp.SetSession(session)
-	return resp
+	return logIn(request, username)
 }
 
-func makeSession(username string) (*compass.Session, *compass.Response) {
-	session, err := server.CreateSession()
-	if err != nil {
-		resp := compass.InternalError(err.Error())
-		return session, &resp
+// logIn stores the user in the session. A session left over from a failed
+// attempt is reused, but gets a new id so nobody who knew the old one is
+// logged in as well.
+func logIn(request compass.Request, username string) compass.Response {
+	session, ok := request.GetSession(server)
+	if !ok {
+		var err error
+		if session, err = server.CreateSession(); err != nil {
+			return compass.InternalError(err.Error())
+		}
 	}
 
 	tx := session.BeginTx()
 	tx.Set("name", username)
-	tx.Commit()
+	if err := tx.Commit(); err != nil {
+		return compass.InternalError(err.Error())
+	}
 
-	return session, nil
+	resp := compass.Redirect("/", false)
+	if err := resp.RegenerateSession(session); err != nil {
+		return compass.InternalError(err.Error())
+	}
+
+	return resp
 }
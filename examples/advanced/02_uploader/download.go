@@ -3,19 +3,34 @@ package main
 import (
 	"github.com/snackbag/compass/v2"
 	"os"
-	"path/filepath"
+	"strings"
 )
 
 func handleDownload(request compass.Request) compass.Response {
-	filename, ok := request.GetRouteParam("file")
+	key, ok := request.GetRouteParam("file")
 	if !ok {
 		return compass.TextWithCode("You need to provide a file name", 400)
 	}
 
-	path := filepath.Join("uploads", filename)
+	// Path rejects keys that would leave the upload directory
+	path, err := store.Path(key)
+	if err != nil {
+		return compass.TextWithCode("There is no such file", 404)
+	}
+
 	if _, err := os.Stat(path); err != nil {
 		return compass.TextWithCode("There is no such file", 404)
 	}
 
-	return compass.DownloadFile(filename, path)
+	return compass.DownloadFile(displayName(key), path)
+}
+
+// displayName strips the "<uuid>_" prefix the store puts in front of every file.
+func displayName(key string) string {
+	_, name, ok := strings.Cut(key, "_")
+	if !ok {
+		return key
+	}
+
+	return name
 }
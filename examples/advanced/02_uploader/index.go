@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"github.com/snackbag/compass/v2"
+	"html"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
@@ -28,7 +30,7 @@ func createTable() string {
 	rv := ``
 
 	for _, entry := range entries {
-		if entry.IsDir() {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
 			continue
 		}
 
@@ -42,8 +44,8 @@ func createTable() string {
 		rv += "<tr>"
 		rv += fmt.Sprintf(
 			`<td><a href="/download/%s">%s</a></td><td>%s</td></tr>`,
-			entry.Name(),
-			entry.Name(),
+			url.PathEscape(entry.Name()),
+			html.EscapeString(displayName(entry.Name())),
 			res.ModTime().Format("02-Jan-2006 15:04"),
 		)
 	}
@@ -10,7 +10,10 @@ func main() {
 	server = compass.NewServer(compass.NewStandardConfiguration())
 
 	server.AddRoute("/", handleIndex)
-	server.AddRoute("/upload", handleUpload).AllowedMethods = []string{"get", "post"}
+	upload := server.AddRoute("/upload", handleUpload)
+	upload.AllowedMethods = []string{"get", "post"}
+	upload.MaxBodySize = MaxUploadSize
+
 	server.AddRoute("/download/<file>", handleDownload)
 
 	server.MustRun()
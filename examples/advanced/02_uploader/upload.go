@@ -1,48 +1,42 @@
 package main
 
 import (
+	"errors"
 	"github.com/snackbag/compass/v2"
-	"io"
-	"os"
-	"path/filepath"
 )
 
+// MaxUploadSize is used as the body limit of the upload route. Compass answers
+// larger requests with a 413 by itself, so we do not need to count bytes here.
 const MaxUploadSize = 128 << 20 // 128MB; << 20 is the magic that converts a number into bytes
 
+// store keeps the uploads in ./uploads. Files are saved as "<uuid>_<name>",
+// so two uploads with the same name do not overwrite each other.
+var store = compass.NewDiskUploadStore("uploads")
+
 func handleUpload(request compass.Request) compass.Response {
 	if request.Method == "get" {
 		return compass.ServeFile("template/upload.html", "index.html")
 	}
 
-	err := request.Http.ParseMultipartForm(MaxUploadSize)
-	if err != nil {
-		return compass.InternalError(err.Error())
-	}
-
-	file, header, err := request.Http.FormFile("file")
-	if err != nil {
-		return compass.Text("Please attach a file!")
-	}
+	// Uploads streams the files straight into the store. File names are
+	// sanitised and half-written files are cleaned up for us.
+	result, err := request.Uploads(compass.UploadOptions{
+		MaxFileSize: MaxUploadSize,
+		MaxFiles:    1,
+		Store:       store,
+	})
 
-	defer file.Close()
-
-	// IMPORTANT! Sanitize your file names! Never trust the client
-	filename := filepath.Base(header.Filename)
-	filename = filepath.Clean(filename)
-
-	path := filepath.Join("uploads", filename)
-	os.MkdirAll(filepath.Dir(path), 0755)
-	upload, err := os.Create(path)
-	if err != nil {
+	switch {
+	case errors.Is(err, compass.ErrUploadTooLarge):
+		return compass.Text("File too large!")
+	case errors.Is(err, compass.ErrTooManyUploads):
+		return compass.Text("Only one file at a time, please!")
+	case err != nil:
 		return compass.InternalError(err.Error())
 	}
-	defer upload.Close()
 
-	limited := io.LimitReader(file, MaxUploadSize+1)
-	n, err := io.Copy(upload, limited)
-	if n > MaxUploadSize {
-		os.Remove(path)
-		return compass.Text("File too large!")
+	if len(result.Files) < 1 {
+		return compass.Text("Please attach a file!")
 	}
 
 	return compass.Redirect("/", false)
@@ -0,0 +1,109 @@
+package compass
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// flashKey is the session key pending flashes are kept under.
+const flashKey = "--COMPASS-Flashes"
+
+// Flash is a one-time message for the next page a client sees, such as
+// "Wrong password" after a redirect back to the login form.
+type Flash struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// Flash adds a message to the session that is returned by the next call
+// to ConsumeFlashes. The category is free-form, e.g. "error" or "success".
+//
+// It is a shorthand for a transaction with a single
+// SessionTransaction.Flash.
+func (s *Session) Flash(category string, message string) error {
+	tx := s.BeginTx()
+	tx.Flash(category, message)
+	return tx.Commit()
+}
+
+// Flash stages a message to be added to the session's flashes on Commit.
+// Messages already pending are kept.
+func (tx *SessionTransaction) Flash(category string, message string) {
+	tx.flashes = append(tx.flashes, Flash{Category: category, Message: message})
+}
+
+// ConsumeFlashes returns the pending flashes of the session in the order
+// they were added, and removes them. A second call returns nothing, so
+// every message is shown exactly once.
+//
+// Templates can use the flashes helper instead, which consumes the
+// flashes of the request's session.
+func (s *Session) ConsumeFlashes() ([]Flash, error) {
+	s.checkReload()
+
+	flashes, consumed, err := s.consumeFlashes()
+	if err != nil || !consumed {
+		return nil, err
+	}
+
+	s.server.OnSessionCommitted(s, SessionReasonFlashes)
+	return flashes, nil
+}
+
+// consumeFlashes removes the flashes under the write lock and saves the
+// session. consumed is false if there were none.
+func (s *Session) consumeFlashes() (flashes []Flash, consumed bool, err error) {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	raw, ok := s.data[flashKey]
+	if !ok || s.destroyed.Load() {
+		return nil, false, nil
+	}
+
+	if err = json.Unmarshal(raw, &flashes); err != nil {
+		flashes = nil
+	}
+
+	delete(s.data, flashKey)
+	if err = s.dump(); err != nil {
+		// Keep them, or they would come back after a restart while this
+		// process has forgotten them.
+		s.data[flashKey] = raw
+		return nil, false, fmt.Errorf("failed to consume flashes: %w", err)
+	}
+
+	return flashes, true, nil
+}
+
+// appendFlashes adds flashes to the ones pending in the session data. It
+// must be called with the write lock held.
+func (s *Session) appendFlashes(flashes []Flash) error {
+	var pending []Flash
+	if raw, ok := s.data[flashKey]; ok {
+		json.Unmarshal(raw, &pending)
+	}
+
+	raw, err := json.Marshal(append(pending, flashes...))
+	if err != nil {
+		return fmt.Errorf("failed to marshal flashes: %w", err)
+	}
+
+	s.data[flashKey] = raw
+	return nil
+}
+
+// requestFlashes consumes the flashes of the request's session for the
+// flashes template helper. Requests without a session have none.
+func (r *Request) requestFlashes() ([]Flash, error) {
+	if r.server == nil {
+		return nil, nil
+	}
+
+	session, ok := r.GetSession(r.server)
+	if !ok {
+		return nil, nil
+	}
+
+	return session.ConsumeFlashes()
+}
@@ -0,0 +1,412 @@
+package compass
+
+import (
+	"bufio"
+	"bytes"
+	"encoding"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// XML converts an object to XML and returns it as a response with status
+// code 200. The standard XML header is prepended.
+//
+// If marshalling fails, an InternalError response is returned instead.
+func XML(obj any) Response {
+	return XMLWithCode(obj, 200)
+}
+
+// XMLWithCode converts an object to XML and returns it with a custom status
+// code.
+//
+// If marshalling fails, an InternalError response is returned instead.
+func XMLWithCode(obj any, code int) Response {
+	content, err := xml.Marshal(obj)
+	if err != nil {
+		return InternalError(fmt.Sprintf("failed to marshal xml object: %s", err))
+	}
+
+	typ := "application/xml; charset=utf-8"
+	return Raw(&typ, append([]byte(xml.Header), content...), code)
+}
+
+// CSV converts rows to CSV and returns them as a response with status code
+// 200.
+//
+// rows is either a [][]string, written as is, or a slice of structs, which
+// gets a header row of field names followed by one row per element. Field
+// names can be changed with a `csv:"name"` tag, fields tagged "-" are
+// skipped.
+//
+// If rows has another type, an InternalError response is returned instead.
+func CSV(rows any) Response {
+	return CSVWithCode(rows, 200)
+}
+
+// CSVWithCode converts rows to CSV and returns them with a custom status
+// code. See CSV for the accepted types.
+func CSVWithCode(rows any, code int) Response {
+	records, err := csvRecords(rows)
+	if err != nil {
+		return InternalError(fmt.Sprintf("failed to marshal csv rows: %s", err))
+	}
+
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	if err = w.WriteAll(records); err != nil {
+		return InternalError(fmt.Sprintf("failed to write csv rows: %s", err))
+	}
+
+	typ := "text/csv; charset=utf-8"
+	return Raw(&typ, buf.Bytes(), code)
+}
+
+// NDJSON streams newline-delimited JSON with status code 200.
+//
+// seq yields one value per line and is called once the headers are sent.
+// Each line is flushed to the client right away. Returning false from
+// yield means the client is gone or a value failed to encode, and seq
+// should stop.
+//
+//	return compass.NDJSON(func(yield func(any) bool) {
+//		for rows.Next() {
+//			if !yield(scanRow(rows)) {
+//				return
+//			}
+//		}
+//	})
+//
+// The signature matches iter.Seq[any].
+func NDJSON(seq func(yield func(any) bool)) Response {
+	return NDJSONWithCode(seq, 200)
+}
+
+// NDJSONWithCode streams newline-delimited JSON with a custom status code.
+func NDJSONWithCode(seq func(yield func(any) bool), code int) Response {
+	typ := "application/x-ndjson"
+	resp := Raw(&typ, nil, code)
+	resp.kind = KindStream
+	resp.stream = func(w http.ResponseWriter, r *http.Request) error {
+		encoder := json.NewEncoder(w)
+		control := http.NewResponseController(w)
+
+		var err error
+		seq(func(v any) bool {
+			if err = encoder.Encode(v); err != nil {
+				return false
+			}
+
+			if err = control.Flush(); err != nil {
+				return false
+			}
+
+			return r.Context().Err() == nil
+		})
+
+		return err
+	}
+
+	return resp
+}
+
+// DecodeJSON reads the request body as JSON into v.
+func (r *Request) DecodeJSON(v any) error {
+	if err := json.NewDecoder(r.Http.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode json body: %w", err)
+	}
+
+	return nil
+}
+
+// DecodeXML reads the request body as XML into v.
+func (r *Request) DecodeXML(v any) error {
+	if err := xml.NewDecoder(r.Http.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed to decode xml body: %w", err)
+	}
+
+	return nil
+}
+
+// DecodeCSV reads the request body as CSV into v, which is either a
+// *[][]string or a pointer to a slice of structs.
+//
+// For structs, the first row is the header. Columns are matched to fields
+// by `csv:"name"` tag or case-insensitively by field name. Unknown columns
+// are ignored.
+func (r *Request) DecodeCSV(v any) error {
+	records, err := csv.NewReader(r.Http.Body).ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to decode csv body: %w", err)
+	}
+
+	if rows, ok := v.(*[][]string); ok {
+		*rows = records
+		return nil
+	}
+
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Pointer || dst.Elem().Kind() != reflect.Slice {
+		return fmt.Errorf("csv: decode target must be *[][]string or a pointer to a slice of structs, got %T", v)
+	}
+
+	slice := dst.Elem()
+	elemType, isPointer := csvElemType(slice.Type())
+	if elemType == nil {
+		return fmt.Errorf("csv: cannot decode into %s", slice.Type())
+	}
+
+	if len(records) == 0 {
+		slice.SetLen(0)
+		return nil
+	}
+
+	fields := csvFields(elemType)
+	columns := make([]int, len(records[0]))
+	for i, name := range records[0] {
+		columns[i] = -1
+		for _, field := range fields {
+			if strings.EqualFold(field.name, strings.TrimSpace(name)) {
+				columns[i] = field.index
+				break
+			}
+		}
+	}
+
+	result := reflect.MakeSlice(slice.Type(), 0, len(records)-1)
+	for line, record := range records[1:] {
+		elem := reflect.New(elemType).Elem()
+		for i, value := range record {
+			if i >= len(columns) || columns[i] < 0 {
+				continue
+			}
+
+			if err = csvParse(elem.Field(columns[i]), value); err != nil {
+				return fmt.Errorf("csv: line %d, column %q: %w", line+2, records[0][i], err)
+			}
+		}
+
+		if isPointer {
+			elem = elem.Addr()
+		}
+		result = reflect.Append(result, elem)
+	}
+
+	slice.Set(result)
+	return nil
+}
+
+// DecodeNDJSON reads the request body as newline-delimited JSON and calls
+// fn with each line. Empty lines are skipped. Reading stops at the first
+// error returned by fn.
+//
+//	err := r.DecodeNDJSON(func(line json.RawMessage) error {
+//		var event Event
+//		if err := json.Unmarshal(line, &event); err != nil {
+//			return err
+//		}
+//		return store(event)
+//	})
+func (r *Request) DecodeNDJSON(fn func(line json.RawMessage) error) error {
+	reader := bufio.NewReader(r.Http.Body)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			if !json.Valid(trimmed) {
+				return fmt.Errorf("failed to decode ndjson body: invalid json line")
+			}
+
+			if fnErr := fn(json.RawMessage(trimmed)); fnErr != nil {
+				return fnErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed to read ndjson body: %w", err)
+		}
+	}
+}
+
+// csvField is an exported struct field and its column name.
+type csvField struct {
+	name  string
+	index int
+}
+
+// csvFields lists the fields of a struct type that become columns.
+func csvFields(t reflect.Type) []csvField {
+	var fields []csvField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := field.Tag.Get("csv")
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		fields = append(fields, csvField{name: name, index: i})
+	}
+
+	return fields
+}
+
+// csvElemType returns the struct type of a slice of structs or struct
+// pointers, or nil for other slices.
+func csvElemType(t reflect.Type) (reflect.Type, bool) {
+	elem := t.Elem()
+	if elem.Kind() == reflect.Pointer && elem.Elem().Kind() == reflect.Struct {
+		return elem.Elem(), true
+	}
+
+	if elem.Kind() == reflect.Struct {
+		return elem, false
+	}
+
+	return nil, false
+}
+
+// csvRecords converts the rows accepted by CSV to records.
+func csvRecords(rows any) ([][]string, error) {
+	if records, ok := rows.([][]string); ok {
+		return records, nil
+	}
+
+	v := reflect.ValueOf(rows)
+	if v.Kind() != reflect.Slice {
+		return nil, fmt.Errorf("unsupported type %T", rows)
+	}
+
+	elemType, _ := csvElemType(v.Type())
+	if elemType == nil {
+		return nil, fmt.Errorf("unsupported type %T", rows)
+	}
+
+	fields := csvFields(elemType)
+	header := make([]string, len(fields))
+	for i, field := range fields {
+		header[i] = field.name
+	}
+
+	records := [][]string{header}
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Pointer {
+			if elem.IsNil() {
+				continue
+			}
+			elem = elem.Elem()
+		}
+
+		record := make([]string, len(fields))
+		for j, field := range fields {
+			value, err := csvFormat(elem.Field(field.index))
+			if err != nil {
+				return nil, fmt.Errorf("field %s: %w", field.name, err)
+			}
+			record[j] = value
+		}
+
+		records = append(records, record)
+	}
+
+	return records, nil
+}
+
+// csvFormat converts a field value to a cell. Types implementing
+// encoding.TextMarshaler, like time.Time, use it.
+func csvFormat(v reflect.Value) (string, error) {
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "", nil
+		}
+		v = v.Elem()
+	}
+
+	if marshaler, ok := v.Interface().(encoding.TextMarshaler); ok {
+		text, err := marshaler.MarshalText()
+		return string(text), err
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String(), nil
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10), nil
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits()), nil
+	}
+
+	return "", fmt.Errorf("unsupported type %s", v.Type())
+}
+
+// csvParse sets a field from a cell. Types implementing
+// encoding.TextUnmarshaler, like time.Time, use it. Empty cells leave
+// pointer fields nil.
+func csvParse(v reflect.Value, value string) error {
+	if v.Kind() == reflect.Pointer {
+		if value == "" {
+			return nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		v = v.Elem()
+	}
+
+	if unmarshaler, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
+		return unmarshaler.UnmarshalText([]byte(value))
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("unsupported type %s", v.Type())
+	}
+
+	return nil
+}
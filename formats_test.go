@@ -0,0 +1,222 @@
+package compass
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type formatsTestRow struct {
+	Name    string    `csv:"name" xml:"name"`
+	Count   int       `csv:"count" xml:"count"`
+	Ratio   float64   `csv:"ratio" xml:"ratio"`
+	Enabled bool      `csv:"enabled" xml:"enabled"`
+	At      time.Time `csv:"at" xml:"at"`
+	Limit   *int      `csv:"limit" xml:"limit,omitempty"`
+	Secret  string    `csv:"-" xml:"-"`
+}
+
+// requestWithBody returns a Request with the given body.
+func requestWithBody(body string) *Request {
+	request := NewRequestFromHttp(httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	return &request
+}
+
+func TestCSVRoundTrip(t *testing.T) {
+	limit := 5
+	rows := []formatsTestRow{
+		{Name: "a, \"quoted\"", Count: 1, Ratio: 0.5, Enabled: true, At: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Limit: &limit, Secret: "x"},
+		{Name: "multi\nline", Count: -2},
+	}
+
+	resp := CSV(rows)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("StatusCode = %d, body %q", resp.StatusCode, resp.Body)
+	}
+
+	header, _, _ := strings.Cut(string(resp.Body), "\n")
+	if header != "name,count,ratio,enabled,at,limit" {
+		t.Fatalf("header = %q", header)
+	}
+
+	var out []formatsTestRow
+	if err := requestWithBody(string(resp.Body)).DecodeCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := rows
+	want[0].Secret = ""
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("decoded %+v, want %+v", out, want)
+	}
+}
+
+func TestCSVRawRecords(t *testing.T) {
+	records := [][]string{{"a", "b"}, {"1", "2"}}
+
+	var out [][]string
+	if err := requestWithBody(string(CSV(records).Body)).DecodeCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out, records) {
+		t.Fatalf("decoded %v, want %v", out, records)
+	}
+}
+
+func TestCSVUnsupportedType(t *testing.T) {
+	if resp := CSV(42); !resp.IsInternalError() {
+		t.Fatalf("CSV(42) = %d, want an internal error", resp.StatusCode)
+	}
+}
+
+func TestDecodeCSVColumns(t *testing.T) {
+	body := "Count,unknown,NAME\n3,ignored,x\n"
+
+	var out []*formatsTestRow
+	if err := requestWithBody(body).DecodeCSV(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(out) != 1 || out[0].Name != "x" || out[0].Count != 3 || out[0].Limit != nil {
+		t.Fatalf("decoded %+v", out)
+	}
+}
+
+func TestDecodeCSVFieldCountMismatch(t *testing.T) {
+	tests := map[string]string{
+		"more fields":  "name,count\nx,1,extra\n",
+		"fewer fields": "name,count\nx\n",
+	}
+
+	for name, body := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out []formatsTestRow
+			if err := requestWithBody(body).DecodeCSV(&out); err == nil {
+				t.Fatalf("decoded %+v, want an error", out)
+			}
+		})
+	}
+}
+
+func TestDecodeCSVInvalidValue(t *testing.T) {
+	var out []formatsTestRow
+	err := requestWithBody("name,count\nx,1\ny,two\n").DecodeCSV(&out)
+	if err == nil || !strings.Contains(err.Error(), `line 3, column "count"`) {
+		t.Fatalf("err = %v, want an error for line 3", err)
+	}
+}
+
+func TestDecodeCSVInvalidTarget(t *testing.T) {
+	var out []string
+	if err := requestWithBody("a\n").DecodeCSV(&out); err == nil {
+		t.Fatal("expected an error for a slice of strings")
+	}
+}
+
+func TestXMLRoundTrip(t *testing.T) {
+	limit := 9
+	in := formatsTestRow{Name: "<a & b>", Count: 2, At: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC), Limit: &limit}
+
+	resp := XML(in)
+	if !bytes.HasPrefix(resp.Body, []byte("<?xml")) {
+		t.Fatalf("body %q has no XML header", resp.Body)
+	}
+
+	var out formatsTestRow
+	if err := requestWithBody(string(resp.Body)).DecodeXML(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(out, in) {
+		t.Fatalf("decoded %+v, want %+v", out, in)
+	}
+}
+
+func TestDecodeXMLMalformed(t *testing.T) {
+	var out formatsTestRow
+	if err := requestWithBody("<formatsTestRow><name>x</formatsTestRow>").DecodeXML(&out); err == nil {
+		t.Fatal("expected an error for mismatched tags")
+	}
+}
+
+func TestDecodeNDJSON(t *testing.T) {
+	var lines []string
+	err := requestWithBody("{\"a\":1}\n\n  [2]  \n\"last\"").DecodeNDJSON(func(line json.RawMessage) error {
+		lines = append(lines, string(line))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{`{"a":1}`, `[2]`, `"last"`}
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("lines = %q, want %q", lines, want)
+	}
+}
+
+func TestDecodeNDJSONInvalidLine(t *testing.T) {
+	calls := 0
+	err := requestWithBody("{\"a\":1}\n{\"a\":\n{\"a\":3}\n").DecodeNDJSON(func(line json.RawMessage) error {
+		calls++
+		return nil
+	})
+	if err == nil || calls != 1 {
+		t.Fatalf("err = %v after %d lines, want an error after 1", err, calls)
+	}
+}
+
+func TestDecodeNDJSONStops(t *testing.T) {
+	stop := errors.New("stop")
+	calls := 0
+	err := requestWithBody("1\n2\n3\n").DecodeNDJSON(func(line json.RawMessage) error {
+		calls++
+		return stop
+	})
+	if !errors.Is(err, stop) || calls != 1 {
+		t.Fatalf("err = %v after %d lines, want %v after 1", err, calls, stop)
+	}
+}
+
+func TestNDJSONStream(t *testing.T) {
+	resp := NDJSON(func(yield func(any) bool) {
+		for i := range 3 {
+			if !yield(map[string]int{"i": i}) {
+				return
+			}
+		}
+	})
+
+	w := httptest.NewRecorder()
+	if err := resp.stream(w, httptest.NewRequest(http.MethodGet, "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	want := "{\"i\":0}\n{\"i\":1}\n{\"i\":2}\n"
+	if w.Body.String() != want {
+		t.Fatalf("body = %q, want %q", w.Body.String(), want)
+	}
+}
+
+func TestMsgPackRequestRoundTrip(t *testing.T) {
+	resp := MsgPack(map[string]string{"a": "b"})
+	if *resp.ContentType != MsgPackContentType {
+		t.Fatalf("ContentType = %q", *resp.ContentType)
+	}
+
+	var out map[string]string
+	if err := requestWithBody(string(resp.Body)).DecodeMsgPack(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out["a"] != "b" {
+		t.Fatalf("decoded %v", out)
+	}
+}
@@ -2,4 +2,4 @@ module github.com/snackbag/compass/v2
 
 go 1.22.7
 
-require github.com/google/uuid v1.6.0 // indirect
+require github.com/google/uuid v1.6.0
@@ -0,0 +1,134 @@
+package compass
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// KeyRingMinKeySize is the minimum length of a secret passed to
+// NewKeyRing, in bytes.
+const KeyRingMinKeySize = 32
+
+// errKeyRingOpen is returned by KeyRing.open for data that was not sealed
+// by any key of the ring, or that was changed afterwards.
+var errKeyRingOpen = errors.New("data was tampered with or sealed with an unknown key")
+
+// KeyRing holds the secrets the server encrypts and authenticates data
+// with, such as cookie sessions.
+//
+// The first key seals new data, every key can open it. To rotate keys, put
+// the new one in front and remove the old one once everything sealed with
+// it has expired or been sealed again.
+type KeyRing struct {
+	keys []ringKey
+}
+
+// ringKey holds the keys derived from one secret, so the same secret is
+// never used for both encryption and authentication.
+type ringKey struct {
+	aead cipher.AEAD
+	mac  []byte
+}
+
+// NewKeyRing creates a KeyRing from one or more secrets of at least
+// KeyRingMinKeySize random bytes, newest first.
+//
+//	secret, _ := base64.StdEncoding.DecodeString(os.Getenv("SESSION_KEY"))
+//	keys, err := compass.NewKeyRing(secret)
+func NewKeyRing(secrets ...[]byte) (*KeyRing, error) {
+	if len(secrets) == 0 {
+		return nil, errors.New("key ring needs at least one key")
+	}
+
+	k := &KeyRing{}
+	for i, secret := range secrets {
+		if len(secret) < KeyRingMinKeySize {
+			return nil, fmt.Errorf("key %d is %d bytes long, but must be at least %d", i, len(secret), KeyRingMinKeySize)
+		}
+
+		block, err := aes.NewCipher(deriveKey(secret, "compass encryption"))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher for key %d: %w", i, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create cipher for key %d: %w", i, err)
+		}
+
+		k.keys = append(k.keys, ringKey{aead: aead, mac: deriveKey(secret, "compass authentication")})
+	}
+
+	return k, nil
+}
+
+// deriveKey derives a 32 byte key for one purpose from a secret.
+func deriveKey(secret []byte, purpose string) []byte {
+	h := hmac.New(sha256.New, secret)
+	h.Write([]byte(purpose))
+	return h.Sum(nil)
+}
+
+// sum returns the HMAC of the context and the sealed data.
+func (k ringKey) sum(context []byte, sealed []byte) []byte {
+	h := hmac.New(sha256.New, k.mac)
+	h.Write(context)
+	h.Write(sealed)
+	return h.Sum(nil)
+}
+
+// seal encrypts plaintext with the first key and appends an HMAC.
+//
+// The context binds the result to where it is used, e.g. a cookie name.
+// Data sealed for one context can't be opened in another.
+//
+// The format is nonce | ciphertext | HMAC-SHA256(context | nonce | ciphertext).
+func (k *KeyRing) seal(plaintext []byte, context []byte) ([]byte, error) {
+	key := k.keys[0]
+
+	nonce := make([]byte, key.aead.NonceSize(), key.aead.NonceSize()+len(plaintext)+key.aead.Overhead()+sha256.Size)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+
+	sealed := key.aead.Seal(nonce, nonce, plaintext, context)
+	return append(sealed, key.sum(context, sealed)...), nil
+}
+
+// open checks the HMAC of sealed data and decrypts it with the key that
+// sealed it. rotated is true if that wasn't the first key, so the caller
+// can seal the data again with the current one.
+func (k *KeyRing) open(data []byte, context []byte) (plaintext []byte, rotated bool, err error) {
+	if len(data) < sha256.Size {
+		return nil, false, errKeyRingOpen
+	}
+
+	sealed, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	for i, key := range k.keys {
+		// The HMAC is checked first, so forged data is rejected without
+		// decrypting it and the right key is found without trying them
+		// all on the ciphertext.
+		if !hmac.Equal(sum, key.sum(context, sealed)) {
+			continue
+		}
+
+		if len(sealed) < key.aead.NonceSize() {
+			return nil, false, errKeyRingOpen
+		}
+
+		nonce, ciphertext := sealed[:key.aead.NonceSize()], sealed[key.aead.NonceSize():]
+		plaintext, err = key.aead.Open(nil, nonce, ciphertext, context)
+		if err != nil {
+			return nil, false, errKeyRingOpen
+		}
+
+		return plaintext, i > 0, nil
+	}
+
+	return nil, false, errKeyRingOpen
+}
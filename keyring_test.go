@@ -0,0 +1,139 @@
+package compass
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"testing"
+)
+
+// newTestSecret returns a random secret of KeyRingMinKeySize bytes.
+func newTestSecret(t *testing.T) []byte {
+	t.Helper()
+
+	secret := make([]byte, KeyRingMinKeySize)
+	if _, err := rand.Read(secret); err != nil {
+		t.Fatal(err)
+	}
+
+	return secret
+}
+
+// newTestKeyRing returns a KeyRing of the secrets, failing the test if it
+// can't be created.
+func newTestKeyRing(t *testing.T, secrets ...[]byte) *KeyRing {
+	t.Helper()
+
+	keys, err := NewKeyRing(secrets...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keys
+}
+
+func TestNewKeyRingRejectsInvalidSecrets(t *testing.T) {
+	if _, err := NewKeyRing(); err == nil {
+		t.Fatal("expected an error without secrets")
+	}
+
+	if _, err := NewKeyRing(newTestSecret(t), make([]byte, KeyRingMinKeySize-1)); err == nil {
+		t.Fatal("expected an error for a short secret")
+	}
+}
+
+func TestKeyRingSealOpen(t *testing.T) {
+	keys := newTestKeyRing(t, newTestSecret(t))
+	plaintext := []byte("hello")
+
+	sealed, err := keys.seal(plaintext, []byte("ctx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, rotated, err := keys.open(sealed, []byte("ctx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(opened, plaintext) || rotated {
+		t.Fatalf("open = %q, rotated %v, want %q, not rotated", opened, rotated, plaintext)
+	}
+
+	again, err := keys.seal(plaintext, []byte("ctx"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Equal(sealed, again) {
+		t.Fatal("sealing twice gave the same bytes")
+	}
+
+	if _, _, err = keys.open(sealed, []byte("other")); !errors.Is(err, errKeyRingOpen) {
+		t.Fatalf("open in another context: err = %v, want %v", err, errKeyRingOpen)
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	oldSecret, newSecret := newTestSecret(t), newTestSecret(t)
+
+	old := newTestKeyRing(t, oldSecret)
+	rotatedRing := newTestKeyRing(t, newSecret, oldSecret)
+	current := newTestKeyRing(t, newSecret)
+
+	sealed, err := old.seal([]byte("old"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opened, rotated, err := rotatedRing.open(sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(opened) != "old" || !rotated {
+		t.Fatalf("open = %q, rotated %v, want %q, rotated", opened, rotated, "old")
+	}
+
+	if _, _, err = current.open(sealed, nil); !errors.Is(err, errKeyRingOpen) {
+		t.Fatalf("open after dropping the old key: err = %v, want %v", err, errKeyRingOpen)
+	}
+
+	// New data is sealed with the first key only.
+	sealed, err = rotatedRing.seal([]byte("new"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, rotated, err = current.open(sealed, nil); err != nil || rotated {
+		t.Fatalf("open with the new key: rotated %v, err %v", rotated, err)
+	}
+
+	if _, _, err = old.open(sealed, nil); !errors.Is(err, errKeyRingOpen) {
+		t.Fatalf("open with the old key: err = %v, want %v", err, errKeyRingOpen)
+	}
+}
+
+func TestKeyRingRejectsTampering(t *testing.T) {
+	keys := newTestKeyRing(t, newTestSecret(t))
+
+	sealed, err := keys.seal([]byte("hello"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := range sealed {
+		tampered := bytes.Clone(sealed)
+		tampered[i] ^= 0x01
+
+		if _, _, err = keys.open(tampered, nil); !errors.Is(err, errKeyRingOpen) {
+			t.Fatalf("byte %d flipped: err = %v, want %v", i, err, errKeyRingOpen)
+		}
+	}
+
+	for n := range len(sealed) {
+		if _, _, err = keys.open(sealed[:n], nil); !errors.Is(err, errKeyRingOpen) {
+			t.Fatalf("truncated to %d bytes: err = %v, want %v", n, err, errKeyRingOpen)
+		}
+	}
+}
@@ -62,7 +62,8 @@ func (s *SimpleLogger) Error(message string) {
 //
 //	2xx = green, 3xx = yellow, 4xx/5xx = red.
 //
-// It also logs the remote address, method, path, and user agent.
+// It also logs the client IP, method, path, and user agent. The client IP
+// honours ServerConfiguration.TrustedProxies, see ClientIPFromHttp.
 func (s *SimpleLogger) Request(r *http.Request, code int) {
 	var colorCode string
 	switch {
@@ -78,7 +79,7 @@ func (s *SimpleLogger) Request(r *http.Request, code int) {
 
 	fmt.Printf(
 		"\x1b[0;34m%s %s%d\033[0m - \033[0;35m%s %s\033[0m \033[0;37m\"%s\"\033[0m\n",
-		r.RemoteAddr, colorCode, code, r.Method, r.URL.Path, r.UserAgent(),
+		ClientIPFromHttp(r), colorCode, code, r.Method, r.URL.Path, r.UserAgent(),
 	)
 }
 
@@ -0,0 +1,755 @@
+package compass
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MsgPackContentType is the content type of MessagePack responses.
+const MsgPackContentType = "application/msgpack"
+
+// msgpackMaxDepth limits nesting while decoding, so hostile input can't
+// exhaust the stack.
+const msgpackMaxDepth = 1000
+
+// errMsgPackShort is returned when the data ends in the middle of a value.
+var errMsgPackShort = errors.New("msgpack: unexpected end of data")
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// MarshalMsgPack encodes v as MessagePack.
+//
+// Structs become maps keyed by field name, or by the name in a
+// `msgpack:"name"` tag. Fields tagged "-" are skipped, fields tagged
+// ",omitempty" are skipped if they hold their zero value. []byte becomes
+// binary data and time.Time the timestamp extension type. Map keys are
+// sorted when they are strings, so the output is deterministic.
+func MarshalMsgPack(v any) ([]byte, error) {
+	e := &msgpackEncoder{}
+	if err := e.encode(reflect.ValueOf(v)); err != nil {
+		return nil, err
+	}
+
+	return e.buf, nil
+}
+
+// UnmarshalMsgPack decodes MessagePack data into the value v points to.
+//
+// Decoding into an interface produces nil, bool, int64, float64, string,
+// []byte, time.Time, []any and map[string]any. Integers above
+// math.MaxInt64 become uint64. Struct fields are matched by tag name or
+// case-insensitively by field name.
+func UnmarshalMsgPack(data []byte, v any) error {
+	dst := reflect.ValueOf(v)
+	if dst.Kind() != reflect.Pointer || dst.IsNil() {
+		return fmt.Errorf("msgpack: decode target must be a non-nil pointer, got %T", v)
+	}
+
+	d := &msgpackDecoder{data: data}
+	value, err := d.decode(0)
+	if err != nil {
+		return err
+	}
+
+	if d.pos != len(d.data) {
+		return fmt.Errorf("msgpack: %d unexpected bytes after value", len(d.data)-d.pos)
+	}
+
+	return msgpackAssign(dst.Elem(), value)
+}
+
+//
+// Encoding
+//
+
+type msgpackEncoder struct {
+	buf []byte
+}
+
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.buf = append(e.buf, 0xc0)
+		return nil
+	}
+
+	if v.Type() == timeType {
+		e.encodeTime(v.Interface().(time.Time))
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 0xc3)
+		} else {
+			e.buf = append(e.buf, 0xc2)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.encodeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.encodeUint(v.Uint())
+	case reflect.Float32:
+		e.buf = append(e.buf, 0xca)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		e.buf = append(e.buf, 0xcb)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.encodeString(v.String())
+	case reflect.Slice:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			e.encodeBinary(v.Bytes())
+			return nil
+		}
+		return e.encodeArray(v)
+	case reflect.Array:
+		return e.encodeArray(v)
+	case reflect.Map:
+		if v.IsNil() {
+			e.buf = append(e.buf, 0xc0)
+			return nil
+		}
+		return e.encodeMap(v)
+	case reflect.Struct:
+		return e.encodeStruct(v)
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", v.Type())
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) encodeInt(n int64) {
+	switch {
+	case n >= 0:
+		e.encodeUint(uint64(n))
+	case n >= -32:
+		e.buf = append(e.buf, byte(n))
+	case n >= math.MinInt8:
+		e.buf = append(e.buf, 0xd0, byte(n))
+	case n >= math.MinInt16:
+		e.buf = append(e.buf, 0xd1)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n >= math.MinInt32:
+		e.buf = append(e.buf, 0xd2)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, 0xd3)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeUint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		e.buf = append(e.buf, byte(n))
+	case n <= math.MaxUint8:
+		e.buf = append(e.buf, 0xcc, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, 0xcd)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	case n <= math.MaxUint32:
+		e.buf = append(e.buf, 0xce)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	default:
+		e.buf = append(e.buf, 0xcf)
+		e.buf = binary.BigEndian.AppendUint64(e.buf, n)
+	}
+}
+
+// encodeLength writes a length prefix, using the fix format if the length
+// fits in fixMax, otherwise the 8 (if code8 is non-zero), 16 or 32 bit
+// format.
+func (e *msgpackEncoder) encodeLength(n int, fix byte, fixMax int, code8 byte, code16 byte, code32 byte) {
+	switch {
+	case fix != 0 && n <= fixMax:
+		e.buf = append(e.buf, fix|byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		e.buf = append(e.buf, code8, byte(n))
+	case n <= math.MaxUint16:
+		e.buf = append(e.buf, code16)
+		e.buf = binary.BigEndian.AppendUint16(e.buf, uint16(n))
+	default:
+		e.buf = append(e.buf, code32)
+		e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(n))
+	}
+}
+
+func (e *msgpackEncoder) encodeString(s string) {
+	e.encodeLength(len(s), 0xa0, 31, 0xd9, 0xda, 0xdb)
+	e.buf = append(e.buf, s...)
+}
+
+func (e *msgpackEncoder) encodeBinary(b []byte) {
+	e.encodeLength(len(b), 0, 0, 0xc4, 0xc5, 0xc6)
+	e.buf = append(e.buf, b...)
+}
+
+// encodeTime writes the timestamp extension (type -1) in its 96 bit form,
+// which covers every time.Time.
+func (e *msgpackEncoder) encodeTime(t time.Time) {
+	e.buf = append(e.buf, 0xc7, 12, 0xff)
+	e.buf = binary.BigEndian.AppendUint32(e.buf, uint32(t.Nanosecond()))
+	e.buf = binary.BigEndian.AppendUint64(e.buf, uint64(t.Unix()))
+}
+
+func (e *msgpackEncoder) encodeArray(v reflect.Value) error {
+	e.encodeLength(v.Len(), 0x90, 15, 0, 0xdc, 0xdd)
+	for i := 0; i < v.Len(); i++ {
+		if err := e.encode(v.Index(i)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) encodeMap(v reflect.Value) error {
+	keys := v.MapKeys()
+	if v.Type().Key().Kind() == reflect.String {
+		sort.Slice(keys, func(i, j int) bool { return keys[i].String() < keys[j].String() })
+	}
+
+	e.encodeLength(len(keys), 0x80, 15, 0, 0xde, 0xdf)
+	for _, key := range keys {
+		if err := e.encode(key); err != nil {
+			return err
+		}
+
+		if err := e.encode(v.MapIndex(key)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (e *msgpackEncoder) encodeStruct(v reflect.Value) error {
+	fields := msgpackFields(v.Type())
+
+	var included []msgpackField
+	for _, field := range fields {
+		if field.omitEmpty && v.Field(field.index).IsZero() {
+			continue
+		}
+		included = append(included, field)
+	}
+
+	e.encodeLength(len(included), 0x80, 15, 0, 0xde, 0xdf)
+	for _, field := range included {
+		e.encodeString(field.name)
+		if err := e.encode(v.Field(field.index)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// msgpackField is an exported struct field and its encoded name.
+type msgpackField struct {
+	name      string
+	index     int
+	omitEmpty bool
+}
+
+// msgpackFields lists the fields of a struct type that are encoded.
+func msgpackFields(t reflect.Type) []msgpackField {
+	var fields []msgpackField
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("msgpack"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = field.Name
+		}
+
+		fields = append(fields, msgpackField{
+			name:      name,
+			index:     i,
+			omitEmpty: options == "omitempty",
+		})
+	}
+
+	return fields
+}
+
+//
+// Decoding
+//
+
+// msgpackPair is a decoded map entry. Maps are kept as pairs until they are
+// assigned, because MessagePack keys can be of any type.
+type msgpackPair struct {
+	key   any
+	value any
+}
+
+type msgpackDecoder struct {
+	data []byte
+	pos  int
+}
+
+func (d *msgpackDecoder) read(n int) ([]byte, error) {
+	if n < 0 || len(d.data)-d.pos < n {
+		return nil, errMsgPackShort
+	}
+
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	b, err := d.read(size)
+	if err != nil {
+		return 0, err
+	}
+
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// readCount reads a length and checks that at least minSize bytes per
+// element are left, so a forged length can't trigger a huge allocation.
+func (d *msgpackDecoder) readCount(size int, minSize int) (int, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return 0, err
+	}
+
+	if n > uint64(len(d.data)-d.pos)/uint64(minSize) {
+		return 0, errMsgPackShort
+	}
+
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) decode(depth int) (any, error) {
+	if depth > msgpackMaxDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+
+	b, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+	code := b[0]
+
+	switch {
+	case code <= 0x7f:
+		return int64(code), nil
+	case code >= 0xe0:
+		return int64(int8(code)), nil
+	case code&0xf0 == 0x80:
+		return d.decodeMap(int(code&0x0f), depth)
+	case code&0xf0 == 0x90:
+		return d.decodeArray(int(code&0x0f), depth)
+	case code&0xe0 == 0xa0:
+		return d.decodeString(int(code & 0x1f))
+	}
+
+	switch code {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readCount(1<<(code-0xc4), 1)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := d.read(n)
+		return append([]byte(nil), raw...), err
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readCount(1<<(code-0xc7), 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeExt(n)
+	case 0xca:
+		n, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(n))), err
+	case 0xcb:
+		n, err := d.readUint(8)
+		return math.Float64frombits(n), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (code - 0xcc))
+	case 0xd0:
+		n, err := d.readUint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return int64(n), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.decodeExt(1 << (code - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readCount(1<<(code-0xd9), 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readCount(2<<(code-0xdc), 1)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n, depth)
+	case 0xde, 0xdf:
+		n, err := d.readCount(2<<(code-0xde), 2)
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n, depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: invalid format byte 0x%02x", code)
+}
+
+func (d *msgpackDecoder) decodeString(n int) (any, error) {
+	b, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+func (d *msgpackDecoder) decodeArray(n int, depth int) (any, error) {
+	values := make([]any, n)
+	for i := range values {
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+
+	return values, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int, depth int) (any, error) {
+	pairs := make([]msgpackPair, n)
+	for i := range pairs {
+		key, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		value, err := d.decode(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+
+		pairs[i] = msgpackPair{key: key, value: value}
+	}
+
+	return pairs, nil
+}
+
+// decodeExt decodes an extension value with n bytes of data. Only the
+// timestamp type (-1) is understood.
+func (d *msgpackDecoder) decodeExt(n int) (any, error) {
+	typ, err := d.read(1)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := d.read(n)
+	if err != nil {
+		return nil, err
+	}
+
+	if int8(typ[0]) != -1 {
+		return nil, fmt.Errorf("msgpack: unsupported extension type %d", int8(typ[0]))
+	}
+
+	switch n {
+	case 4:
+		return time.Unix(int64(binary.BigEndian.Uint32(data)), 0), nil
+	case 8:
+		v := binary.BigEndian.Uint64(data)
+		return time.Unix(int64(v&0x3ffffffff), int64(v>>34)), nil
+	case 12:
+		return time.Unix(int64(binary.BigEndian.Uint64(data[4:])), int64(binary.BigEndian.Uint32(data))), nil
+	}
+
+	return nil, fmt.Errorf("msgpack: invalid timestamp length %d", n)
+}
+
+// msgpackPlain converts decoded maps to map[string]any and unsigned
+// integers that fit to int64, for storing in an interface.
+func msgpackPlain(value any) any {
+	switch v := value.(type) {
+	case []msgpackPair:
+		m := make(map[string]any, len(v))
+		for _, pair := range v {
+			key, ok := pair.key.(string)
+			if !ok {
+				key = fmt.Sprint(msgpackPlain(pair.key))
+			}
+			m[key] = msgpackPlain(pair.value)
+		}
+		return m
+	case []any:
+		for i := range v {
+			v[i] = msgpackPlain(v[i])
+		}
+		return v
+	case uint64:
+		if v <= math.MaxInt64 {
+			return int64(v)
+		}
+	}
+
+	return value
+}
+
+// msgpackAssign stores a decoded value in dst, converting it to dst's type.
+func msgpackAssign(dst reflect.Value, value any) error {
+	if value == nil {
+		dst.SetZero()
+		return nil
+	}
+
+	if dst.Type() == timeType {
+		t, ok := value.(time.Time)
+		if !ok {
+			return msgpackTypeError(dst, value)
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+
+	switch dst.Kind() {
+	case reflect.Pointer:
+		if dst.IsNil() {
+			dst.Set(reflect.New(dst.Type().Elem()))
+		}
+		return msgpackAssign(dst.Elem(), value)
+	case reflect.Interface:
+		plain := reflect.ValueOf(msgpackPlain(value))
+		if !plain.Type().AssignableTo(dst.Type()) {
+			return msgpackTypeError(dst, value)
+		}
+		dst.Set(plain)
+	case reflect.Bool:
+		b, ok := value.(bool)
+		if !ok {
+			return msgpackTypeError(dst, value)
+		}
+		dst.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var n int64
+		switch v := value.(type) {
+		case int64:
+			n = v
+		case uint64:
+			if v > math.MaxInt64 {
+				return msgpackTypeError(dst, value)
+			}
+			n = int64(v)
+		default:
+			return msgpackTypeError(dst, value)
+		}
+		if dst.OverflowInt(n) {
+			return msgpackTypeError(dst, value)
+		}
+		dst.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		var n uint64
+		switch v := value.(type) {
+		case uint64:
+			n = v
+		case int64:
+			if v < 0 {
+				return msgpackTypeError(dst, value)
+			}
+			n = uint64(v)
+		default:
+			return msgpackTypeError(dst, value)
+		}
+		if dst.OverflowUint(n) {
+			return msgpackTypeError(dst, value)
+		}
+		dst.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		switch v := value.(type) {
+		case float64:
+			dst.SetFloat(v)
+		case int64:
+			dst.SetFloat(float64(v))
+		case uint64:
+			dst.SetFloat(float64(v))
+		default:
+			return msgpackTypeError(dst, value)
+		}
+	case reflect.String:
+		switch v := value.(type) {
+		case string:
+			dst.SetString(v)
+		case []byte:
+			dst.SetString(string(v))
+		default:
+			return msgpackTypeError(dst, value)
+		}
+	case reflect.Slice:
+		if dst.Type().Elem().Kind() == reflect.Uint8 {
+			switch v := value.(type) {
+			case []byte:
+				dst.SetBytes(v)
+				return nil
+			case string:
+				dst.SetBytes([]byte(v))
+				return nil
+			}
+		}
+
+		values, ok := value.([]any)
+		if !ok {
+			return msgpackTypeError(dst, value)
+		}
+
+		slice := reflect.MakeSlice(dst.Type(), len(values), len(values))
+		for i, v := range values {
+			if err := msgpackAssign(slice.Index(i), v); err != nil {
+				return err
+			}
+		}
+		dst.Set(slice)
+	case reflect.Array:
+		values, ok := value.([]any)
+		if !ok || len(values) != dst.Len() {
+			return msgpackTypeError(dst, value)
+		}
+
+		for i, v := range values {
+			if err := msgpackAssign(dst.Index(i), v); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		pairs, ok := value.([]msgpackPair)
+		if !ok {
+			return msgpackTypeError(dst, value)
+		}
+
+		m := reflect.MakeMapWithSize(dst.Type(), len(pairs))
+		for _, pair := range pairs {
+			key := reflect.New(dst.Type().Key()).Elem()
+			if err := msgpackAssign(key, pair.key); err != nil {
+				return err
+			}
+
+			elem := reflect.New(dst.Type().Elem()).Elem()
+			if err := msgpackAssign(elem, pair.value); err != nil {
+				return err
+			}
+
+			m.SetMapIndex(key, elem)
+		}
+		dst.Set(m)
+	case reflect.Struct:
+		pairs, ok := value.([]msgpackPair)
+		if !ok {
+			return msgpackTypeError(dst, value)
+		}
+
+		fields := msgpackFields(dst.Type())
+		for _, pair := range pairs {
+			name, ok := pair.key.(string)
+			if !ok {
+				continue
+			}
+
+			for _, field := range fields {
+				if field.name == name || strings.EqualFold(field.name, name) {
+					if err := msgpackAssign(dst.Field(field.index), pair.value); err != nil {
+						return err
+					}
+					break
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %s", dst.Type())
+	}
+
+	return nil
+}
+
+func msgpackTypeError(dst reflect.Value, value any) error {
+	return fmt.Errorf("msgpack: cannot decode %T into %s", value, dst.Type())
+}
+
+// MsgPack encodes an object as MessagePack and returns it as a response
+// with status code 200.
+//
+// If encoding fails, an InternalError response is returned instead.
+func MsgPack(obj any) Response {
+	return MsgPackWithCode(obj, 200)
+}
+
+// MsgPackWithCode encodes an object as MessagePack and returns it with a
+// custom status code.
+//
+// If encoding fails, an InternalError response is returned instead.
+func MsgPackWithCode(obj any, code int) Response {
+	content, err := MarshalMsgPack(obj)
+	if err != nil {
+		return InternalError(fmt.Sprintf("failed to marshal msgpack object: %s", err))
+	}
+
+	typ := MsgPackContentType
+	return Raw(&typ, content, code)
+}
+
+// DecodeMsgPack reads the request body as MessagePack into v.
+func (r *Request) DecodeMsgPack(v any) error {
+	data, err := io.ReadAll(r.Http.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read msgpack body: %w", err)
+	}
+
+	return UnmarshalMsgPack(data, v)
+}
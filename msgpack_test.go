@@ -0,0 +1,203 @@
+package compass
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type msgpackTestItem struct {
+	Name    string            `msgpack:"name"`
+	Count   int               `msgpack:"count"`
+	Big     uint64            `msgpack:"big"`
+	Ratio   float64           `msgpack:"ratio"`
+	Enabled bool              `msgpack:"enabled"`
+	Data    []byte            `msgpack:"data"`
+	Tags    []string          `msgpack:"tags"`
+	Labels  map[string]int    `msgpack:"labels"`
+	Child   *msgpackTestItem  `msgpack:"child"`
+	At      time.Time         `msgpack:"at"`
+	Note    string            `msgpack:"note,omitempty"`
+	Secret  string            `msgpack:"-"`
+	Extra   map[string]string `msgpack:"extra"`
+}
+
+func TestMsgPackRoundTrip(t *testing.T) {
+	in := msgpackTestItem{
+		Name:    "widget",
+		Count:   -42,
+		Big:     1 << 63,
+		Ratio:   0.25,
+		Enabled: true,
+		Data:    []byte{0, 1, 2, 255},
+		Tags:    []string{"a", strings.Repeat("b", 300)},
+		Labels:  map[string]int{"x": 1, "y": 70000},
+		Child:   &msgpackTestItem{Name: "child", At: time.Unix(1, 0)},
+		At:      time.Unix(1700000000, 123456789),
+		Secret:  "dropped",
+	}
+
+	data, err := MarshalMsgPack(in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out msgpackTestItem
+	if err = UnmarshalMsgPack(data, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := in
+	want.Secret = ""
+	if !out.At.Equal(want.At) || !out.Child.At.Equal(want.Child.At) {
+		t.Fatalf("At = %v, %v, want %v, %v", out.At, out.Child.At, want.At, want.Child.At)
+	}
+
+	out.At, want.At = time.Time{}, time.Time{}
+	out.Child.At, want.Child.At = time.Time{}, time.Time{}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("decoded %+v, want %+v", out, want)
+	}
+}
+
+func TestMsgPackDeterministic(t *testing.T) {
+	value := map[string]int{"c": 3, "a": 1, "b": 2}
+
+	first, err := MarshalMsgPack(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for range 10 {
+		again, err := MarshalMsgPack(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(first, again) {
+			t.Fatal("encoding a map twice gave different bytes")
+		}
+	}
+}
+
+func TestMsgPackDecodeIntoInterface(t *testing.T) {
+	data, err := MarshalMsgPack(map[string]any{
+		"n":    7,
+		"big":  uint64(1 << 63),
+		"list": []any{"x", nil, true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out any
+	if err = UnmarshalMsgPack(data, &out); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]any{
+		"n":    int64(7),
+		"big":  uint64(1 << 63),
+		"list": []any{"x", nil, true},
+	}
+	if !reflect.DeepEqual(out, want) {
+		t.Fatalf("decoded %#v, want %#v", out, want)
+	}
+}
+
+func TestMsgPackForgedLengths(t *testing.T) {
+	tests := map[string][]byte{
+		"str32":   {0xdb, 0xff, 0xff, 0xff, 0xff, 'a'},
+		"bin32":   {0xc6, 0xff, 0xff, 0xff, 0xff, 0x00},
+		"array32": {0xdd, 0xff, 0xff, 0xff, 0xff, 0xc0},
+		"map32":   {0xdf, 0xff, 0xff, 0xff, 0xff, 0xc0, 0xc0},
+		"ext32":   {0xc9, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"array16": {0xdc, 0xff, 0xff},
+		"map16":   {0xde, 0x00, 0x02, 0xc0, 0xc0},
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out any
+			if err := UnmarshalMsgPack(data, &out); !errors.Is(err, errMsgPackShort) {
+				t.Fatalf("err = %v, want %v", err, errMsgPackShort)
+			}
+		})
+	}
+}
+
+func TestMsgPackDeepNesting(t *testing.T) {
+	data := append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth+1), 0xc0)
+
+	var out any
+	err := UnmarshalMsgPack(data, &out)
+	if err == nil || !strings.Contains(err.Error(), "nesting too deep") {
+		t.Fatalf("err = %v, want nesting too deep", err)
+	}
+
+	data = append(bytes.Repeat([]byte{0x91}, msgpackMaxDepth), 0xc0)
+	if err = UnmarshalMsgPack(data, &out); err != nil {
+		t.Fatalf("nesting at the limit: %v", err)
+	}
+}
+
+func TestMsgPackTruncated(t *testing.T) {
+	data, err := MarshalMsgPack(msgpackTestItem{
+		Name:   "widget",
+		Data:   []byte("data"),
+		Tags:   []string{"a", "b"},
+		Labels: map[string]int{"x": 300},
+		At:     time.Unix(1700000000, 1),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := range len(data) {
+		var out msgpackTestItem
+		if err := UnmarshalMsgPack(data[:n], &out); !errors.Is(err, errMsgPackShort) {
+			t.Fatalf("%d of %d bytes: err = %v, want %v", n, len(data), err, errMsgPackShort)
+		}
+	}
+}
+
+func TestMsgPackTrailingBytes(t *testing.T) {
+	var out any
+	if err := UnmarshalMsgPack([]byte{0xc0, 0xc0}, &out); err == nil {
+		t.Fatal("expected an error for trailing bytes")
+	}
+}
+
+func TestMsgPackUnknownExtension(t *testing.T) {
+	tests := map[string][]byte{
+		"fixext1": {0xd4, 0x05, 0x00},
+		"ext8":    {0xc7, 0x02, 0x7f, 0x00, 0x00},
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			var out any
+			err := UnmarshalMsgPack(data, &out)
+			if err == nil || !strings.Contains(err.Error(), "unsupported extension type") {
+				t.Fatalf("err = %v, want unsupported extension type", err)
+			}
+		})
+	}
+
+	var out any
+	err := UnmarshalMsgPack([]byte{0xc7, 0x03, 0xff, 0x00, 0x00, 0x00}, &out)
+	if err == nil || !strings.Contains(err.Error(), "invalid timestamp length") {
+		t.Fatalf("err = %v, want invalid timestamp length", err)
+	}
+}
+
+func TestMsgPackInvalidFormatByte(t *testing.T) {
+	var out any
+	err := UnmarshalMsgPack([]byte{0xc1}, &out)
+	if err == nil || !strings.Contains(err.Error(), "invalid format byte") {
+		t.Fatalf("err = %v, want invalid format byte", err)
+	}
+}
@@ -0,0 +1,358 @@
+package compass
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// clientInfoKey is the context key under which the resolved clientInfo
+// of a request is stored.
+type clientInfoKey struct{}
+
+// clientInfo holds the client address, scheme and host of a request as
+// resolved by resolveClient. forwarded is set if the host came from a
+// trusted proxy rather than the request itself.
+type clientInfo struct {
+	ip        string
+	scheme    string
+	host      string
+	forwarded bool
+}
+
+// forwardedElement is a single comma-separated element of a Forwarded
+// header (RFC 7239). Unknown parameters are dropped.
+type forwardedElement struct {
+	forAddr string
+	proto   string
+	host    string
+}
+
+// parseTrustedProxies converts a list of CIDR strings into prefixes.
+//
+// Plain IP addresses are accepted as well and are treated as a single
+// host prefix. Entries that cannot be parsed are returned in the second
+// value, so CheckValidity can report them.
+func parseTrustedProxies(raw []string) ([]netip.Prefix, []string) {
+	prefixes := make([]netip.Prefix, 0, len(raw))
+	invalid := make([]string, 0)
+
+	for _, entry := range raw {
+		entry = strings.TrimSpace(entry)
+
+		prefix, err := netip.ParsePrefix(entry)
+		if err == nil {
+			prefixes = append(prefixes, prefix.Masked())
+			continue
+		}
+
+		addr, err := netip.ParseAddr(entry)
+		if err == nil {
+			addr = addr.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+
+		invalid = append(invalid, entry)
+	}
+
+	return prefixes, invalid
+}
+
+// isTrustedProxy reports whether the address is contained in one of the
+// configured TrustedProxies.
+func (s *Server) isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range s.trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveClient determines the client address, scheme and host of a request
+// and stores them in the request's context.
+//
+// Proxy headers are only honoured if the direct peer (RemoteAddr) is a
+// trusted proxy. If a Forwarded header is present, it is the only one used
+// for the address, scheme and host. Otherwise, the address comes from
+// X-Forwarded-For, or X-Real-IP if that is missing, and the scheme and host
+// from X-Forwarded-Proto and X-Forwarded-Host. Chains are walked from right to
+// left, skipping trusted proxies, so a client cannot spoof its address by
+// sending its own headers.
+func (s *Server) resolveClient(r *http.Request) *http.Request {
+	info := directClientInfo(r)
+
+	remote, ok := parseForwardedAddr(r.RemoteAddr)
+	if !ok || !s.isTrustedProxy(remote) {
+		return r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info))
+	}
+
+	// A proxy that sends Forwarded is trusted to send all of it, so the
+	// X-Forwarded-* headers are not mixed in, even for the parts it left
+	// out. They may have been passed through from the client.
+	if forwarded := r.Header.Values("Forwarded"); len(forwarded) > 0 {
+		elements := parseForwarded(forwarded)
+		if len(elements) == 0 {
+			return r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info))
+		}
+
+		hops := make([]string, len(elements))
+		for i, element := range elements {
+			hops[i] = element.forAddr
+		}
+
+		addr, index := s.walkProxyChain(remote, hops)
+		info.ip = addr.String()
+
+		if index >= 0 {
+			if proto := strings.ToLower(elements[index].proto); proto == "http" || proto == "https" {
+				info.scheme = proto
+			}
+			if isValidHost(elements[index].host) {
+				info.host = elements[index].host
+				info.forwarded = true
+			}
+		}
+
+		return r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info))
+	}
+
+	if hops := splitHeaderList(r.Header.Values("X-Forwarded-For")); len(hops) > 0 {
+		addr, _ := s.walkProxyChain(remote, hops)
+		info.ip = addr.String()
+	} else if realIP, ok := parseForwardedAddr(r.Header.Get("X-Real-IP")); ok {
+		info.ip = realIP.String()
+	}
+
+	if protos := splitHeaderList(r.Header.Values("X-Forwarded-Proto")); len(protos) > 0 {
+		if proto := strings.ToLower(protos[len(protos)-1]); proto == "http" || proto == "https" {
+			info.scheme = proto
+		}
+	}
+
+	if hosts := splitHeaderList(r.Header.Values("X-Forwarded-Host")); len(hosts) > 0 {
+		if host := hosts[len(hosts)-1]; isValidHost(host) {
+			info.host = host
+			info.forwarded = true
+		}
+	}
+
+	return r.WithContext(context.WithValue(r.Context(), clientInfoKey{}, info))
+}
+
+// walkProxyChain walks a list of forwarded addresses from right to left and
+// returns the first address that is not a trusted proxy, together with its
+// index in hops.
+//
+// If an entry cannot be parsed, the walk stops and the last trusted address
+// is returned with an index of -1. If every entry is trusted, the leftmost
+// one is returned.
+func (s *Server) walkProxyChain(remote netip.Addr, hops []string) (netip.Addr, int) {
+	current := remote
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseForwardedAddr(hops[i])
+		if !ok {
+			return current, -1
+		}
+
+		current = addr
+		if !s.isTrustedProxy(addr) {
+			return current, i
+		}
+	}
+
+	return current, 0
+}
+
+// directClientInfo returns the clientInfo of a request as seen on the wire,
+// without consulting any proxy headers. A Host that could change the
+// meaning of a URL is dropped.
+func directClientInfo(r *http.Request) clientInfo {
+	info := clientInfo{ip: r.RemoteAddr, scheme: "http"}
+
+	if isValidHost(r.Host) {
+		info.host = r.Host
+	}
+
+	if addr, ok := parseForwardedAddr(r.RemoteAddr); ok {
+		info.ip = addr.String()
+	}
+
+	if r.TLS != nil {
+		info.scheme = "https"
+	}
+
+	return info
+}
+
+// requestClientInfo returns the clientInfo stored by resolveClient, or the
+// direct connection info if the request did not pass through Run.
+func requestClientInfo(r *http.Request) clientInfo {
+	if info, ok := r.Context().Value(clientInfoKey{}).(clientInfo); ok {
+		return info
+	}
+
+	return directClientInfo(r)
+}
+
+// ClientIPFromHttp returns the resolved client IP of a standard http.Request.
+//
+// This is meant for custom Logger implementations, which only receive the
+// *http.Request. Inside handlers, use Request.ClientIP instead.
+func ClientIPFromHttp(r *http.Request) string {
+	return requestClientInfo(r).ip
+}
+
+// ClientIP returns the IP address of the client that made the request.
+//
+// If the direct peer is listed in ServerConfiguration.TrustedProxies, the
+// Forwarded header is consulted, or, without one, X-Forwarded-For and
+// X-Real-IP. Otherwise, the address of the direct peer is returned.
+func (r *Request) ClientIP() string {
+	return requestClientInfo(r.Http).ip
+}
+
+// Scheme returns "https" or "http", depending on how the client reached the
+// server.
+//
+// Behind a trusted proxy, the proto of the Forwarded header is used. Only
+// if there is no Forwarded header, X-Forwarded-Proto is used instead.
+func (r *Request) Scheme() string {
+	return requestClientInfo(r.Http).scheme
+}
+
+// Host returns the host the client addressed, including the port if one
+// was given.
+//
+// Behind a trusted proxy, the host of the Forwarded header is used. Only
+// if there is no Forwarded header, X-Forwarded-Host is used instead.
+func (r *Request) Host() string {
+	return requestClientInfo(r.Http).host
+}
+
+// absoluteURL turns a path-absolute target such as "/login" into a full URL
+// using the scheme and host a trusted proxy forwarded. Any other target is
+// returned unchanged.
+//
+// Without a trusted proxy, the target stays path-relative. The client
+// resolves it against the URL it requested, which is the right one, and
+// the Location can't be pointed elsewhere by a forged Host header.
+func (r *Request) absoluteURL(target string) string {
+	if !strings.HasPrefix(target, "/") || strings.HasPrefix(target, "//") {
+		return target
+	}
+
+	info := requestClientInfo(r.Http)
+	if !info.forwarded {
+		return target
+	}
+
+	return info.scheme + "://" + info.host + target
+}
+
+// parseForwarded parses all Forwarded header values into their elements,
+// in the order they appear.
+func parseForwarded(values []string) []forwardedElement {
+	elements := make([]forwardedElement, 0)
+
+	for _, value := range values {
+		for _, raw := range splitQuoted(value, ',') {
+			element := forwardedElement{}
+
+			for _, pair := range splitQuoted(raw, ';') {
+				key, val, ok := strings.Cut(pair, "=")
+				if !ok {
+					continue
+				}
+
+				val = strings.Trim(strings.TrimSpace(val), `"`)
+				switch strings.ToLower(strings.TrimSpace(key)) {
+				case "for":
+					element.forAddr = val
+				case "proto":
+					element.proto = val
+				case "host":
+					element.host = val
+				}
+			}
+
+			elements = append(elements, element)
+		}
+	}
+
+	return elements
+}
+
+// parseForwardedAddr parses an address as it appears in RemoteAddr or in
+// proxy headers. Ports, brackets and quotes are stripped.
+//
+// Obfuscated identifiers and "unknown" (RFC 7239) are reported as invalid.
+func parseForwardedAddr(raw string) (netip.Addr, bool) {
+	raw = strings.Trim(strings.TrimSpace(raw), `"`)
+	if raw == "" {
+		return netip.Addr{}, false
+	}
+
+	if host, _, err := net.SplitHostPort(raw); err == nil {
+		raw = host
+	} else if strings.HasPrefix(raw, "[") && strings.HasSuffix(raw, "]") {
+		raw = raw[1 : len(raw)-1]
+	}
+
+	addr, err := netip.ParseAddr(raw)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
+
+// splitHeaderList splits comma-separated header values into trimmed,
+// non-empty entries.
+func splitHeaderList(values []string) []string {
+	result := make([]string, 0)
+	for _, value := range values {
+		for _, entry := range strings.Split(value, ",") {
+			entry = strings.TrimSpace(entry)
+			if entry != "" {
+				result = append(result, entry)
+			}
+		}
+	}
+
+	return result
+}
+
+// splitQuoted splits s on sep, ignoring separators inside double quotes.
+func splitQuoted(s string, sep rune) []string {
+	parts := make([]string, 0)
+	quoted := false
+	start := 0
+
+	for i, c := range s {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == sep && !quoted:
+			parts = append(parts, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+
+	return append(parts, strings.TrimSpace(s[start:]))
+}
+
+// isValidHost reports whether a forwarded host value is safe to use in
+// generated URLs.
+func isValidHost(host string) bool {
+	if host == "" || len(host) > 255 {
+		return false
+	}
+
+	return !strings.ContainsAny(host, "/\\@?# \t\r\n")
+}
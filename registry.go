@@ -0,0 +1,115 @@
+package compass
+
+import (
+	"hash/fnv"
+	"sync"
+)
+
+// registryShards is the number of shards of a sessionRegistry. Requests for
+// different sessions rarely wait on each other with this many.
+const registryShards = 32
+
+// sessionRegistry is the set of loaded sessions of a Server, by id.
+//
+// It is split into shards with their own lock, so request goroutines
+// looking up sessions don't all contend on one mutex with CreateSession and
+// the session reaper.
+type sessionRegistry struct {
+	shards [registryShards]registryShard
+}
+
+type registryShard struct {
+	mutex    sync.RWMutex
+	sessions map[string]*Session
+}
+
+// newSessionRegistry creates an empty sessionRegistry.
+func newSessionRegistry() *sessionRegistry {
+	r := &sessionRegistry{}
+	for i := range r.shards {
+		r.shards[i].sessions = make(map[string]*Session)
+	}
+
+	return r
+}
+
+// shard returns the shard an id belongs to.
+func (r *sessionRegistry) shard(id string) *registryShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &r.shards[h.Sum32()%registryShards]
+}
+
+// get returns the session with the given id.
+func (r *sessionRegistry) get(id string) (*Session, bool) {
+	shard := r.shard(id)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	session, ok := shard.sessions[id]
+	return session, ok
+}
+
+// put adds a session, replacing any session with the same id.
+func (r *sessionRegistry) put(session *Session) {
+	shard := r.shard(session.ID())
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	shard.sessions[session.ID()] = session
+}
+
+// delete removes a session if it is still the one registered under its id.
+// This keeps a stale reference from removing a session that replaced it.
+func (r *sessionRegistry) delete(session *Session) {
+	shard := r.shard(session.ID())
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	if shard.sessions[session.ID()] == session {
+		delete(shard.sessions, session.ID())
+	}
+}
+
+// move re-registers a session under its new id after Regenerate. It is
+// removed from oldID first, so the old id can't find it anymore by the
+// time the new cookie is sent.
+func (r *sessionRegistry) move(session *Session, oldID string) {
+	shard := r.shard(oldID)
+	shard.mutex.Lock()
+	if shard.sessions[oldID] == session {
+		delete(shard.sessions, oldID)
+	}
+	shard.mutex.Unlock()
+
+	r.put(session)
+}
+
+// all returns a snapshot of the registered sessions. Sessions created or
+// removed while the caller works with it are not reflected.
+func (r *sessionRegistry) all() []*Session {
+	var sessions []*Session
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mutex.RLock()
+		for _, session := range shard.sessions {
+			sessions = append(sessions, session)
+		}
+		shard.mutex.RUnlock()
+	}
+
+	return sessions
+}
+
+// len returns the number of registered sessions.
+func (r *sessionRegistry) len() int {
+	n := 0
+	for i := range r.shards {
+		shard := &r.shards[i]
+		shard.mutex.RLock()
+		n += len(shard.sessions)
+		shard.mutex.RUnlock()
+	}
+
+	return n
+}
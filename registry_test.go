@@ -0,0 +1,202 @@
+package compass
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newRegistryTestServer returns a server with an in-memory store, so tests
+// don't touch the disk.
+func newRegistryTestServer() *Server {
+	config := NewStandardConfiguration()
+	config.SessionExpiryTime = int(time.Hour.Milliseconds())
+
+	server := NewServer(config)
+	server.SessionStore = NewMemorySessionStore()
+	return server
+}
+
+// requestWithSession returns a Request carrying the session cookie of id.
+func requestWithSession(server *Server, id string) *Request {
+	httpRequest := httptest.NewRequest(http.MethodGet, "/", nil)
+	httpRequest.AddCookie(&http.Cookie{Name: sessionCookieName, Value: id})
+
+	request := NewRequestFromHttp(httpRequest)
+	request.server = server
+	return &request
+}
+
+func TestRegistryConcurrentCreateGetExpireRegenerate(t *testing.T) {
+	server := newRegistryTestServer()
+
+	const workers = 16
+	const perWorker = 50
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	var kept, expiring []*Session
+
+	for w := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range perWorker {
+				session, err := server.CreateSession()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				tx := session.BeginTx()
+				if err = tx.Set("n", i); err != nil {
+					t.Error(err)
+					return
+				}
+
+				// Every other session expires almost right away, so the
+				// reaper removes it while the others are still used.
+				expires := (w+i)%2 == 0
+				if expires {
+					tx.SetIdleTimeout(time.Millisecond)
+				}
+
+				if err = tx.Commit(); err != nil {
+					t.Error(err)
+					return
+				}
+
+				if i%5 == 0 && !expires {
+					if err = session.Regenerate(); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+
+				if found, ok := requestWithSession(server, session.ID()).GetSession(server); ok && found != session {
+					t.Errorf("GetSession(%s) returned a different session", session.ID())
+				}
+
+				if _, err = SessionGet[int](session, "n"); err != nil && !session.IsDestroyed() {
+					t.Error(err)
+				}
+
+				mutex.Lock()
+				if expires {
+					expiring = append(expiring, session)
+				} else {
+					kept = append(kept, session)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	reaped := make(chan struct{})
+	go func() {
+		defer close(reaped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				server.reapSessions()
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(done)
+	<-reaped
+
+	time.Sleep(5 * time.Millisecond)
+	server.reapSessions()
+
+	for _, session := range kept {
+		found, ok := server.sessions.get(session.ID())
+		if !ok || found != session {
+			t.Fatalf("session %s is not registered under its id", session.ID())
+		}
+
+		if session.IsDestroyed() {
+			t.Fatalf("session %s was destroyed, but didn't expire", session.ID())
+		}
+	}
+
+	for _, session := range expiring {
+		if _, ok := server.sessions.get(session.ID()); ok {
+			t.Fatalf("expired session %s is still registered", session.ID())
+		}
+
+		if _, ok := requestWithSession(server, session.ID()).GetSession(server); ok {
+			t.Fatalf("expired session %s is still returned by GetSession", session.ID())
+		}
+	}
+
+	if got := server.sessions.len(); got != len(kept) {
+		t.Fatalf("registry holds %d sessions, want %d", got, len(kept))
+	}
+
+	ids, err := server.SessionStore.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != len(kept) {
+		t.Fatalf("store holds %d sessions, want %d", len(ids), len(kept))
+	}
+}
+
+func TestRegistryMoveDuringLookups(t *testing.T) {
+	server := newRegistryTestServer()
+
+	session, err := server.CreateSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+
+				if found, ok := server.sessions.get(session.ID()); ok && found != session {
+					t.Error("lookup returned a different session")
+					return
+				}
+			}
+		}()
+	}
+
+	for range 100 {
+		oldID := session.ID()
+		if err = session.Regenerate(); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := server.sessions.get(oldID); ok {
+			t.Fatalf("old id %s still finds the session", oldID)
+		}
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if server.sessions.len() != 1 {
+		t.Fatalf("registry holds %d sessions, want 1", server.sessions.len())
+	}
+}
@@ -1,11 +1,15 @@
 package compass
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
+	"io"
+	"mime"
 	"net/http"
 	"net/url"
+	"path/filepath"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -16,59 +20,263 @@ type Request struct {
 	Route  *Route
 
 	Http *http.Request
+
+	server  *Server
+	csrf    *csrfState
+	session *sessionState
 }
 
 // NewRequestFromHttp constructs a Request from a standard http.Request.
 //
 // The HTTP method is normalized to lowercase. The Route field is not
-// populated and must be assigned later during routing.
+// populated and must be assigned later during routing. Features that
+// need the Server, such as Uploads without an explicit store, are only
+// available on requests dispatched by Server.Run.
 func NewRequestFromHttp(r *http.Request) Request {
 	return Request{
 		Method: strings.ToLower(r.Method),
 		URL:    r.URL,
 
 		Http: r,
+
+		csrf:    &csrfState{},
+		session: &sessionState{},
 	}
 }
 
-// writeResponse writes the headers, content type, status code, and body
-// of a Response to the client.
-//
-// Headers prefixed with "--COMPASS" are skipped. This is the shared
-// path for all standard responses.
-func (s *Server) writeResponse(w http.ResponseWriter, r Request, resp Response) error {
+// writeHeaders writes the cookies and headers of a Response. Headers
+// prefixed with "--COMPASS" are skipped, see isInternalHeader.
+func (s *Server) writeHeaders(w http.ResponseWriter, resp Response) {
 	s.writeCookies(w, resp.cookies)
 
-	for key, value := range resp.Headers {
-		if strings.HasPrefix(key, "--COMPASS") {
+	for key, values := range resp.Headers {
+		if isInternalHeader(key) {
 			continue
 		}
-		w.Header().Set(key, value)
+
+		w.Header().Del(key)
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+}
+
+// isInternalHeader reports whether a header is reserved for Compass and
+// must not be sent. Header keys are canonicalised by http.Header, so they
+// are compared case-insensitively.
+func isInternalHeader(key string) bool {
+	return strings.HasPrefix(strings.ToLower(key), "--compass")
+}
+
+// prepareResponse finishes a response before it is written: pending
+// templates are rendered and a freshly generated CSRF token is attached
+// as a cookie.
+//
+// Calling it on an already prepared response does nothing.
+func (s *Server) prepareResponse(r Request, resp Response) (Response, error) {
+	if err := s.renderTemplate(&r, &resp); err != nil {
+		return resp, err
+	}
+
+	r.attachCSRFCookie(&resp)
+	if err := s.attachSessionCookies(&r, &resp); err != nil {
+		return resp, err
+	}
+
+	return resp, nil
+}
+
+// renderTemplate renders the pending template of a response into its Body.
+// Responses without one are left unchanged.
+func (s *Server) renderTemplate(r *Request, resp *Response) error {
+	if resp.template == nil {
+		return nil
+	}
+
+	body, err := s.Templates.render(r, resp.template.name, resp.template.data)
+	if err != nil {
+		return err
+	}
+
+	resp.Body = body
+	resp.template = nil
+	return nil
+}
+
+// writeResponse writes a Response to the client according to its kind.
+//
+//	KindPlain: headers, content type, status code and Body
+//	KindStream: the same, but the stream function writes the body
+//	KindRedirect: an HTTP redirect, path-absolute targets are resolved
+//	              against the client's scheme and host
+//	KindServe: the content via http.ServeContent, including Range and
+//	           conditional requests. ContentType overrides the type
+//	           derived from the file name. With a status code other
+//	           than 200, the whole content is sent with that code
+//	KindUpgrade: headers and cookies, then hands the connection to the
+//	             stream function, which takes it over and writes the
+//	             status line itself (e.g. WebSocket)
+//
+// This is the shared path for all responses, so handlers like the
+// NotFoundHandler can return any kind as well.
+func (s *Server) writeResponse(w http.ResponseWriter, r Request, resp Response) error {
+	resp, err := s.prepareResponse(r, resp)
+	if err != nil {
+		return err
+	}
+
+	switch resp.kind {
+	case KindRedirect:
+		s.writeHeaders(w, resp)
+		http.Redirect(w, r.Http, r.absoluteURL(resp.location), resp.StatusCode)
+		s.Logger.Request(r.Http, resp.StatusCode)
+		return nil
+	case KindServe:
+		defer resp.discard()
+		s.writeHeaders(w, resp)
+		if resp.ContentType != nil {
+			w.Header().Set("Content-Type", *resp.ContentType)
+		}
+		if resp.StatusCode != http.StatusOK {
+			return s.writeServeWithCode(w, r, resp)
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		http.ServeContent(recorder, r.Http, resp.serve.name, resp.serve.modTime, resp.serve.reader)
+		s.Logger.Request(r.Http, recorder.status)
+		return nil
+	case KindUpgrade:
+		s.writeHeaders(w, resp)
+		s.Logger.Request(r.Http, resp.StatusCode)
+		return resp.stream(w, r.Http)
 	}
 
+	s.writeHeaders(w, resp)
+
 	if resp.ContentType != nil {
 		w.Header().Set("Content-Type", *resp.ContentType)
 	} else {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	}
 
+	if resp.kind == KindStream && resp.stream != nil {
+		s.writeStream(w, r, resp)
+		return nil
+	}
+
 	return s.write(w, r.Http, resp.Body, resp.StatusCode)
 }
 
+// writeServeWithCode writes the whole content of a serve response with a
+// status code other than 200, such as a file served as a custom error page.
+// Range and conditional requests only apply to 200 responses, so they are
+// ignored here.
+func (s *Server) writeServeWithCode(w http.ResponseWriter, r Request, resp Response) error {
+	content := resp.serve.reader
+
+	size, err := content.Seek(0, io.SeekEnd)
+	if err == nil {
+		_, err = content.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to seek content of %s: %w", resp.serve.name, err)
+	}
+
+	if w.Header().Get("Content-Type") == "" {
+		contentType := mime.TypeByExtension(filepath.Ext(resp.serve.name))
+		if contentType == "" {
+			sniff := make([]byte, 512)
+			n, _ := io.ReadFull(content, sniff)
+			contentType = http.DetectContentType(sniff[:n])
+
+			if _, err = content.Seek(0, io.SeekStart); err != nil {
+				return fmt.Errorf("failed to seek content of %s: %w", resp.serve.name, err)
+			}
+		}
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+
+	s.Logger.Request(r.Http, resp.StatusCode)
+	w.WriteHeader(resp.StatusCode)
+
+	if r.Method == "head" || !bodyAllowed(resp.StatusCode) {
+		return nil
+	}
+
+	if _, err = io.Copy(w, content); err != nil {
+		return fmt.Errorf("failed to write content of %s: %w", resp.serve.name, err)
+	}
+
+	return nil
+}
+
+// statusRecorder remembers the status code written through it, for
+// responses whose code is chosen by something else, like
+// http.ServeContent.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Unwrap returns the underlying ResponseWriter for http.ResponseController.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// writeStream writes the status code and then lets the response's stream
+// function write the body directly to the client. Trailers are announced
+// before and sent after the body.
+//
+// Once the status code is sent, errors can no longer be reported to the
+// client. They are logged and passed to the AlertHandler instead, and the
+// connection is cut short.
+func (s *Server) writeStream(w http.ResponseWriter, r Request, resp Response) {
+	for key := range resp.Trailers {
+		w.Header().Add("Trailer", http.CanonicalHeaderKey(key))
+	}
+
+	s.Logger.Request(r.Http, resp.StatusCode)
+	w.WriteHeader(resp.StatusCode)
+
+	if err := resp.stream(w, r.Http); err != nil {
+		err = fmt.Errorf("failed to stream response for %s: %w", r.URL.Path, err)
+		s.Logger.Error(err.Error())
+		s.AlertHandler(err)
+		return
+	}
+
+	for key, values := range resp.Trailers {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+}
+
 // handleRequest processes an incoming Request and writes the response.
 //
 // If no route is matched, it delegates to handleNotFound. Otherwise,
 // it executes the route handler and writes the resulting response,
 // including headers, status code, and body.
 //
-// Special internal ContentType values control behavior:
+// If the route has a body limit, the request body is wrapped with
+// http.MaxBytesReader. Overflows, either by Content-Length or while reading,
+// are answered by the PayloadTooLargeHandler.
 //
-//	"--COMPASS-redirect": performs an HTTP redirect
-//	"--COMPASS-serve": serves content as a file
+// The Postprocessor sees every response before it is written, whatever
+// its kind. How a response is written is decided by writeResponse.
 //
-// Headers prefixed with "--COMPASS" are ignored. All successful
-// responses are logged. If the handler signals an internal error,
-// it is returned.
+// Successful GET and HEAD responses get an automatic ETag if configured
+// and are answered with 304 or 412 if the request's preconditions fail.
+//
+// All successful responses are logged. If the handler signals an internal
+// error, it is returned.
 func (s *Server) handleRequest(w http.ResponseWriter, r Request) error {
 	if r.Route == nil {
 		return s.writeResponse(w, r, s.NotFoundHandler(r))
@@ -78,37 +286,96 @@ func (s *Server) handleRequest(w http.ResponseWriter, r Request) error {
 		return s.writeResponse(w, r, s.MethodNotAllowedHandler(r))
 	}
 
+	var body *limitedBody
+	if limit := s.bodyLimit(r.Route); limit > 0 {
+		if r.Http.ContentLength > limit {
+			return s.writeResponse(w, r, s.PayloadTooLargeHandler(r))
+		}
+
+		body = &limitedBody{ReadCloser: http.MaxBytesReader(w, r.Http.Body, limit)}
+		r.Http.Body = body
+	}
+
 	pResp := s.Preprocessor(r)
 	var resp Response
 	if pResp != nil {
 		resp = *pResp
+	} else if r.Route.ResponseCache != nil {
+		resp = r.Route.ResponseCache.handle(s, r)
 	} else {
 		resp = r.Route.handler(r)
 	}
 
+	if body != nil && body.exceeded {
+		resp.discard()
+		return s.writeResponse(w, r, s.PayloadTooLargeHandler(r))
+	}
+
 	if resp.internalError {
 		return errors.New(string(resp.Body))
 	}
 
-	if resp.ContentType != nil {
-		switch *resp.ContentType {
-		case "--COMPASS-redirect":
-			s.writeCookies(w, resp.cookies)
-			http.Redirect(w, r.Http, string(resp.Body), resp.StatusCode)
-			s.Logger.Request(r.Http, resp.StatusCode)
-			return nil
-		case "--COMPASS-serve":
-			rs := bytes.NewReader(resp.Body)
-			s.writeCookies(w, resp.cookies)
-			http.ServeContent(w, r.Http, resp.Headers["-Compass-File-Name"], time.Now(), rs)
-			s.Logger.Request(r.Http, resp.StatusCode)
-			return nil
-		}
+	resp, err := s.prepareResponse(r, resp)
+	if err != nil {
+		return err
 	}
 
+	resp = s.postprocess(r, resp)
+	if resp.internalError {
+		return errors.New(string(resp.Body))
+	}
+
+	resp = applyRouteCache(r.Route, resp)
+	resp = s.applyConditional(r, resp)
 	return s.writeResponse(w, r, resp)
 }
 
+// postprocess passes a response through the Postprocessor. If the
+// Postprocessor replaces a serve response, the original content is closed,
+// since nothing else would.
+func (s *Server) postprocess(r Request, resp Response) Response {
+	original := resp.serve
+	resp = s.Postprocessor(r, resp)
+
+	if original != nil && resp.serve != original {
+		(&Response{serve: original}).discard()
+	}
+
+	return resp
+}
+
+// limitedBody wraps a request body limited by http.MaxBytesReader and
+// remembers whether the limit was hit.
+//
+// This lets handleRequest replace whatever the handler returned with the
+// PayloadTooLargeHandler, even if the handler swallowed the read error.
+type limitedBody struct {
+	io.ReadCloser
+	exceeded bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		b.exceeded = true
+	}
+
+	return n, err
+}
+
+// bodyLimit returns the effective maximum body size for a route.
+//
+// A return value of zero or below means the body is not limited.
+func (s *Server) bodyLimit(route *Route) int64 {
+	if route.MaxBodySize != 0 {
+		return route.MaxBodySize
+	}
+
+	return s.Config.MaxBodySize
+}
+
 // GetRouteParam returns the value of a named route parameter.
 //
 // The parameter is resolved using the route's internal mapping and
@@ -171,21 +438,34 @@ func (r *Request) GetCookies() map[string]string {
 // the incoming request.
 //
 // The second return value is false if no valid session was found,
-// no cookie was set, or the session was destroyed.
+// no cookie was set, or the session was destroyed or has expired.
+//
+// With Server.SessionCookieKeys, the session is opened from the cookie
+// instead, once per request.
 func (r *Request) GetSession(server *Server) (*Session, bool) {
-	cookie, ok := r.GetCookie("_compassId")
+	if server.SessionCookieKeys != nil {
+		return r.cookieSession(server)
+	}
+
+	cookie, ok := r.GetCookie(sessionCookieName)
 	if !ok {
 		return nil, false
 	}
 
-	session, ok := server.sessions[cookie]
+	session, ok := server.sessions.get(cookie)
 	if !ok {
 		return nil, false
 	}
 
-	if session.destroyed {
+	// Expired sessions are destroyed by the next reaper tick, but must not
+	// be used until then.
+	if session.IsDestroyed() || session.expired(time.Now().UnixMilli()) {
 		return nil, false
 	}
 
+	if r.session != nil {
+		r.session.session = session
+	}
+
 	return session, true
 }
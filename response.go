@@ -1,25 +1,130 @@
 package compass
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"time"
 )
 
 var asciiFallback = regexp.MustCompile(`[^A-Za-z0-9 ._-]+`)
 
+// ResponseKind tells the pipeline how a Response is written. It is set by
+// the constructors and can be read with Response.Kind.
+type ResponseKind int
+
+const (
+	// KindPlain responses write Body, or a rendered template.
+	KindPlain ResponseKind = iota
+	// KindRedirect responses redirect the client to Location.
+	KindRedirect
+	// KindServe responses serve a file-like resource with
+	// http.ServeContent, including Range and conditional requests.
+	KindServe
+	// KindStream responses write their body with a function once the
+	// headers are sent.
+	KindStream
+	// KindUpgrade responses take over the connection, e.g. for WebSockets.
+	KindUpgrade
+)
+
+// String returns the lowercase name of the kind, e.g. "redirect".
+func (k ResponseKind) String() string {
+	switch k {
+	case KindPlain:
+		return "plain"
+	case KindRedirect:
+		return "redirect"
+	case KindServe:
+		return "serve"
+	case KindStream:
+		return "stream"
+	case KindUpgrade:
+		return "upgrade"
+	}
+
+	return fmt.Sprintf("ResponseKind(%d)", int(k))
+}
+
 type Response struct {
 	internalError bool
 	cookies       []Cookie
+	kind          ResponseKind
+
+	// location is the target of redirect responses.
+	location string
+
+	// serve backs serve responses, so files can be served with Range
+	// support without reading them into memory.
+	serve *serveContent
+
+	// template, if set, is rendered into Body by prepareResponse.
+	template *templateJob
+
+	// session is a cookie session passed to SetSession. It is sealed into
+	// the cookies by prepareResponse, after the handler is done with it.
+	session *Session
+
+	// stream, if set, writes the body of stream and upgrade responses.
+	stream func(w http.ResponseWriter, r *http.Request) error
 
 	ContentType *string
 	Body        []byte
 	StatusCode  int
-	Headers     map[string]string
+	Headers     http.Header
+
+	// Trailers are sent after the body of a streamed response. Their names
+	// must be in the map before the response is written, the values can be
+	// filled in by the stream function.
+	Trailers http.Header
+}
+
+// serveContent is the content of a serve response.
+type serveContent struct {
+	reader  io.ReadSeeker
+	name    string
+	modTime time.Time
+}
+
+// Kind returns how the response is written.
+func (r Response) Kind() ResponseKind {
+	return r.kind
+}
+
+// Location returns the target of a redirect response. It is empty for all
+// other kinds.
+func (r Response) Location() string {
+	return r.location
+}
+
+// FileName returns the name a serve response is served under, which
+// determines its content type unless ContentType is set. It is empty for
+// all other kinds.
+func (r Response) FileName() string {
+	if r.serve == nil {
+		return ""
+	}
+
+	return r.serve.name
+}
+
+// IsInternalError reports whether the response was created by
+// InternalError. Its Body is the message for the AlertHandler and is never
+// sent to the client.
+func (r Response) IsInternalError() bool {
+	return r.internalError
+}
+
+// Cookies returns a copy of the cookies attached to the response.
+func (r Response) Cookies() []Cookie {
+	return slices.Clone(r.cookies)
 }
 
 // SetCookie attaches a cookie to the response.
@@ -43,9 +148,68 @@ func (r *Response) RemoveCookie(name string) {
 // This ensures that future calls can properly read the session. You must run
 // this method if you want to keep the session in future request.
 func (r *Response) SetSession(session *Session) {
+	if session.cookieStore != nil {
+		r.session = session
+		return
+	}
+
 	r.SetCookie(session.cookie())
 }
 
+// RegenerateSession moves the session to a new id with
+// Session.Regenerate and attaches the new session cookie to the response.
+//
+//	if err := resp.RegenerateSession(session); err != nil {
+//		return compass.InternalError(err.Error())
+//	}
+func (r *Response) RegenerateSession(session *Session) error {
+	if err := session.Regenerate(); err != nil {
+		return err
+	}
+
+	r.SetSession(session)
+	return nil
+}
+
+// SetHeader sets a header, replacing any existing values.
+func (r *Response) SetHeader(key string, value string) {
+	r.ensureHeaders()
+	r.Headers.Set(key, value)
+}
+
+// AddHeader adds a value to a header, keeping existing values. Each value
+// is sent as its own header line, as needed for Link or WWW-Authenticate.
+func (r *Response) AddHeader(key string, value string) {
+	r.ensureHeaders()
+	r.Headers.Add(key, value)
+}
+
+// DelHeader removes all values of a header.
+func (r *Response) DelHeader(key string) {
+	r.Headers.Del(key)
+}
+
+// ensureHeaders initialises Headers for responses not built by a
+// constructor.
+func (r *Response) ensureHeaders() {
+	if r.Headers == nil {
+		r.Headers = make(http.Header)
+	}
+}
+
+// discard releases the resources held by a response that is not going to
+// be written, or has been written already. It closes the content of serve
+// responses if it is an io.Closer.
+func (r *Response) discard() {
+	if r.serve == nil {
+		return
+	}
+
+	if closer, ok := r.serve.reader.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
 // writeCookies writes a list of cookies as Set-Cookie headers.
 //
 // Set-Cookie is the one HTTP header that repeats, so each
@@ -76,7 +240,7 @@ func Raw(contentType *string, body []byte, code int) Response {
 		ContentType: contentType,
 		Body:        body,
 		StatusCode:  code,
-		Headers:     make(map[string]string),
+		Headers:     make(http.Header),
 	}
 }
 
@@ -91,7 +255,7 @@ func InternalError(message string) Response {
 		ContentType: nil,
 		Body:        []byte(message),
 		StatusCode:  500,
-		Headers:     make(map[string]string),
+		Headers:     make(http.Header),
 	}
 }
 
@@ -167,6 +331,16 @@ func DownloadBytes(filename string, data []byte) Response {
 // The filename is sanitized for ASCII compatibility while preserving the
 // original name for UTF-8 capable clients.
 func DownloadBytesWithCode(filename string, data []byte, code int) Response {
+	resp := Raw(nil, data, code)
+	resp.Headers.Set("Content-Disposition", contentDisposition(filename))
+	return resp
+}
+
+// contentDisposition builds an attachment Content-Disposition header value.
+//
+// The filename is sanitized for ASCII compatibility while preserving the
+// original name for UTF-8 capable clients.
+func contentDisposition(filename string) string {
 	ascii := strings.TrimSpace(filename)
 	ascii = asciiFallback.ReplaceAllString(ascii, "_")
 
@@ -174,29 +348,34 @@ func DownloadBytesWithCode(filename string, data []byte, code int) Response {
 		ascii = "download"
 	}
 
-	resp := Raw(nil, data, code)
-	resp.Headers["Content-Disposition"] = `attachment; filename="` + ascii + `"; filename*=UTF-8''` + url.PathEscape(filename)
-	return resp
+	return `attachment; filename="` + ascii + `"; filename*=UTF-8''` + url.PathEscape(filename)
 }
 
-// DownloadFile reads a file from disk and returns it as a download response.
+// DownloadFile streams a file from disk as a download response.
 //
-// If the file cannot be read, an internal error response is returned.
+// The file is not read into memory. Range and conditional requests are
+// supported. If the file cannot be opened, an internal error response
+// is returned.
 func DownloadFile(filename string, path string) Response {
 	return DownloadFileWithCode(filename, path, 200)
 }
 
-// DownloadFileWithCode reads a file from disk and returns it as a download
-// response with a custom status code.
+// DownloadFileWithCode streams a file from disk as a download response
+// with a custom status code.
 //
-// If the file cannot be read, an internal error response is returned.
+// The file is not read into memory. Range and conditional requests are
+// supported if the code is 200. With any other code, the whole file is
+// sent with it. If the file cannot be opened, an internal error response
+// is returned.
 func DownloadFileWithCode(filename string, path string, code int) Response {
-	data, err := os.ReadFile(path)
+	file, stat, err := openRegularFile(path)
 	if err != nil {
 		return InternalError(fmt.Sprintf("failed to prepare file data for download: %s", err))
 	}
 
-	return DownloadBytesWithCode(filename, data, code)
+	resp := ServeContentWithCode(file, filename, stat.ModTime(), code)
+	resp.Headers.Set("Content-Disposition", contentDisposition(filename))
+	return resp
 }
 
 // Redirect creates a redirect response to the given target.
@@ -204,20 +383,26 @@ func DownloadFileWithCode(filename string, path string, code int) Response {
 // If retainMethod is true, a 307 redirect is used. Otherwise, a 303
 // redirect is used, which converts the request to a GET.
 func Redirect(target string, retainMethod bool) Response {
-	typ := "--COMPASS-redirect"
 	status := http.StatusSeeOther
 	if retainMethod {
 		status = http.StatusTemporaryRedirect
 	}
 
-	return Raw(&typ, []byte(target), status)
+	return redirectWithCode(target, status)
 }
 
 // PermaRedirect creates a permanent redirect (HTTP 308) to the target URL.
 // The method which a request uses is retained.
 func PermaRedirect(target string) Response {
-	typ := "--COMPASS-redirect"
-	return Raw(&typ, []byte(target), http.StatusPermanentRedirect)
+	return redirectWithCode(target, http.StatusPermanentRedirect)
+}
+
+// redirectWithCode creates a redirect response with the given status code.
+func redirectWithCode(target string, code int) Response {
+	resp := Raw(nil, nil, code)
+	resp.kind = KindRedirect
+	resp.location = target
+	return resp
 }
 
 // ServeBytes creates a response that serves data as a file-like resource
@@ -237,30 +422,135 @@ func ServeBytes(data []byte, name string) Response {
 // (e.g. browser) may choose to display the content inline if it supports it
 // (such as images, text, or PDFs).
 func ServeBytesWithCode(data []byte, name string, code int) Response {
-	typ := "--COMPASS-serve"
-	raw := Raw(&typ, data, code)
-	raw.Headers["-Compass-File-Name"] = name
+	return ServeContentWithCode(bytes.NewReader(data), name, time.Now(), code)
+}
+
+// ServeContent creates a response that serves content from an
+// io.ReadSeeker as a file-like resource with status code 200.
+//
+// The content is streamed with http.ServeContent, so Range and conditional
+// requests are supported and memory use does not depend on its size. If
+// content is also an io.Closer, it is closed after the response is written.
+func ServeContent(content io.ReadSeeker, name string, modTime time.Time) Response {
+	return ServeContentWithCode(content, name, modTime, 200)
+}
+
+// ServeContentWithCode creates a response that serves content from an
+// io.ReadSeeker as a file-like resource with a custom status code.
+//
+// With code 200, the content is streamed with http.ServeContent, so Range
+// and conditional requests are supported. With any other code, such as a
+// 404 page, the whole content is sent with that code. Either way, memory
+// use does not depend on its size. If content is also an io.Closer, it is
+// closed after the response is written.
+func ServeContentWithCode(content io.ReadSeeker, name string, modTime time.Time, code int) Response {
+	raw := Raw(nil, nil, code)
+	raw.kind = KindServe
+	raw.serve = &serveContent{reader: content, name: name, modTime: modTime}
 	return raw
 }
 
-// ServeFile reads a file from disk and serves it as a file-like response.
+// ServeFile streams a file from disk as a file-like response.
 //
-// This behaves the same as ServeBytes, but reads the file from disk first.
-// If the file cannot be read, an internal error response is returned.
+// This behaves the same as ServeBytes, but the file is streamed instead of
+// being read into memory. If the file cannot be opened, an internal error
+// response is returned.
 func ServeFile(path string, name string) Response {
 	return ServeFileWithCode(path, name, 200)
 }
 
-// ServeFileWithCode reads a file from disk and serves it as a file-like
-// response with a custom status code.
+// ServeFileWithCode streams a file from disk as a file-like response with
+// a custom status code.
 //
-// This behaves the same as ServeBytes, but reads the file from disk first.
-// If the file cannot be read, an internal error response is returned.
+// This behaves the same as ServeBytesWithCode, but the file is streamed
+// instead of being read into memory. If the file cannot be opened, an internal error
+// response is returned.
 func ServeFileWithCode(path string, name string, code int) Response {
-	data, err := os.ReadFile(path)
+	file, stat, err := openRegularFile(path)
 	if err != nil {
 		return InternalError(fmt.Sprintf("failed to prepare file data for serve: %s", err))
 	}
 
-	return ServeBytesWithCode(data, name, code)
+	return ServeContentWithCode(file, name, stat.ModTime(), code)
+}
+
+// openRegularFile opens a file for streaming and returns it with its
+// FileInfo. Directories are rejected.
+func openRegularFile(path string) (*os.File, os.FileInfo, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stat, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+
+	if stat.IsDir() {
+		file.Close()
+		return nil, nil, fmt.Errorf("%s is a directory", path)
+	}
+
+	return file, stat, nil
+}
+
+// Stream creates a response whose body is written by fn with status
+// code 200.
+//
+// fn writes directly to the client, so large bodies like CSV exports can
+// be generated with constant memory. If contentType is empty, the default
+// "text/plain; charset=utf-8" is used.
+//
+// Once fn is called, the status code and headers are already sent. Errors
+// returned by fn are logged and passed to the AlertHandler.
+func Stream(contentType string, fn func(w io.Writer) error) Response {
+	return StreamWithCode(contentType, fn, 200)
+}
+
+// StreamWithCode creates a response whose body is written by fn with a
+// custom status code.
+//
+// fn writes directly to the client, so large bodies like CSV exports can
+// be generated with constant memory. If contentType is empty, the default
+// "text/plain; charset=utf-8" is used.
+//
+// Once fn is called, the status code and headers are already sent. Errors
+// returned by fn are logged and passed to the AlertHandler.
+func StreamWithCode(contentType string, fn func(w io.Writer) error, code int) Response {
+	var typ *string
+	if contentType != "" {
+		typ = &contentType
+	}
+
+	raw := Raw(typ, nil, code)
+	raw.kind = KindStream
+	raw.stream = func(w http.ResponseWriter, r *http.Request) error {
+		return fn(w)
+	}
+	return raw
+}
+
+// StreamReader creates a response that copies its body from r with
+// status code 200.
+//
+// If r is also an io.Closer, it is closed once the body is written.
+func StreamReader(contentType string, r io.Reader) Response {
+	return StreamReaderWithCode(contentType, r, 200)
+}
+
+// StreamReaderWithCode creates a response that copies its body from r
+// with a custom status code.
+//
+// If r is also an io.Closer, it is closed once the body is written.
+func StreamReaderWithCode(contentType string, r io.Reader, code int) Response {
+	return StreamWithCode(contentType, func(w io.Writer) error {
+		if closer, ok := r.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		_, err := io.Copy(w, r)
+		return err
+	}, code)
 }
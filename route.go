@@ -2,6 +2,7 @@ package compass
 
 import (
 	"fmt"
+	"net/url"
 	"regexp"
 	"strings"
 )
@@ -21,6 +22,21 @@ type Route struct {
 
 	AllowedMethods []string
 
+	// Name identifies the route for Server.URLFor and the urlFor template
+	// helper. Unnamed routes cannot be looked up.
+	Name string
+
+	// Cache is the CachePolicy applied to successful responses of this
+	// route that don't set Cache-Control themselves.
+	Cache *CachePolicy
+
+	// ResponseCache, if set, stores the responses of this route in memory.
+	ResponseCache *ResponseCache
+
+	// MaxBodySize overrides ServerConfiguration.MaxBodySize for this route.
+	// Zero inherits the server limit, a negative value disables the limit.
+	MaxBodySize int64
+
 	repr string
 }
 
@@ -161,6 +177,67 @@ func createParts(path string) []routePart {
 	return parts
 }
 
+// FindRouteByName returns the route with the given Name, or nil if no
+// route has that name.
+func (s *Server) FindRouteByName(name string) *Route {
+	if name == "" {
+		return nil
+	}
+
+	for _, candidates := range s.routes {
+		for _, candidate := range candidates {
+			if candidate.Name == name {
+				return candidate
+			}
+		}
+	}
+
+	return nil
+}
+
+// URLFor builds the path of a named route, filling in its parameters.
+//
+// Parameters are given as name-value pairs and are path-escaped. An error
+// is returned if the route does not exist, a parameter is missing, or the
+// pairs are incomplete.
+//
+//	path, err := server.URLFor("user", "id", "42") // "/users/42"
+func (s *Server) URLFor(name string, params ...string) (string, error) {
+	route := s.FindRouteByName(name)
+	if route == nil {
+		return "", fmt.Errorf("no route named %q", name)
+	}
+
+	if len(params)%2 != 0 {
+		return "", fmt.Errorf("odd number of parameters for route %q", name)
+	}
+
+	values := make(map[string]string)
+	for i := 0; i < len(params); i += 2 {
+		values[strings.ToLower(params[i])] = params[i+1]
+	}
+
+	var b strings.Builder
+	for _, part := range route.parts {
+		b.WriteString("/")
+		b.WriteString(part.prefix)
+
+		if part.id == "" {
+			continue
+		}
+
+		value, ok := values[part.id]
+		if !ok {
+			return "", fmt.Errorf("missing parameter %q for route %q", part.id, name)
+		}
+
+		b.WriteString(url.PathEscape(value))
+		b.WriteString(part.suffix)
+	}
+
+	return b.String(), nil
+}
+
 // FindRoute attempts to match a given path to a registered route.
 //
 // The path is split into segments and only routes with the same
@@ -1,12 +1,12 @@
 package compass
 
 import (
-	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"io/fs"
 	"log"
 	"net/http"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"strings"
@@ -20,7 +20,45 @@ type ServerConfiguration struct {
 	StaticUrl  string `json:"static_url"`
 	CompassDir string `json:"compass_dir"`
 
-	SessionExpiryTime   int `json:"session_expiry_time"`
+	// DevMode enables conveniences for local development, such as reloading
+	// templates when they change on disk.
+	DevMode bool `json:"dev_mode"`
+
+	// TrustedProxies lists the CIDR ranges of proxies whose forwarding
+	// headers are trusted when resolving the client IP, scheme and host.
+	TrustedProxies []string `json:"trusted_proxies"`
+
+	// MaxBodySize is the maximum size of a request body in bytes. Routes
+	// can override it with Route.MaxBodySize. Zero disables the limit.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	// Compression enables compressing responses with the server's Encoders
+	// if the client accepts one of them.
+	Compression bool `json:"compression"`
+
+	// CompressionMinSize is the smallest body in bytes that is compressed.
+	// Smaller bodies are not worth the overhead.
+	CompressionMinSize int `json:"compression_min_size"`
+
+	// CompressionTypes lists the content types that are compressed. Entries
+	// ending in "/*" match a whole top-level type. Nil uses
+	// DefaultCompressionTypes.
+	CompressionTypes []string `json:"compression_types"`
+
+	// ETags enables automatic ETags for GET and HEAD responses of routes:
+	// ETagsStrong, ETagsWeak, or ETagsOff.
+	ETags string `json:"etags"`
+
+	// SessionExpiryTime is how long a session lives without being
+	// accessed, in milliseconds. Sessions can override it with
+	// SessionTransaction.SetIdleTimeout.
+	SessionExpiryTime int `json:"session_expiry_time"`
+
+	// SessionMaxLifetime is how long a session lives after it was created,
+	// no matter how active it is, in milliseconds. Zero means no limit.
+	// Sessions can override it with SessionTransaction.SetMaxLifetime.
+	SessionMaxLifetime int `json:"session_max_lifetime"`
+
 	SessionTickInterval int `json:"session_tick_interval"`
 }
 
@@ -28,17 +66,75 @@ type Server struct {
 	Config       ServerConfiguration
 	Logger       Logger
 	AlertHandler func(err error)
+	Templates    *TemplateEngine
+
+	// StaticCache returns the CachePolicy for a static file, given its path
+	// relative to the static directory. By default, fingerprinted files are
+	// cached for a year and everything else is revalidated.
+	StaticCache func(name string) CachePolicy
+
+	// Encoders are the content codings used for compression, in order of
+	// preference. Defaults to gzip and deflate.
+	Encoders []Encoder
+
+	// SessionStore keeps the sessions. Defaults to a FileSessionStore in
+	// CompassDir/session. It must be set before Run.
+	SessionStore SessionStore
+
+	// SessionCookieKeys switches to cookie sessions if set. Instead of
+	// being kept in the SessionStore, each session is encrypted with the
+	// keys into the client's cookies, so replicas need no shared storage.
+	SessionCookieKeys *KeyRing
+
+	// Session hooks are called with the session and a SessionReason after
+	// the change is saved, without any session lock held, so they may use
+	// the session. They run on the goroutine that made the change, which
+	// is a request handler or the session reaper, and should return
+	// quickly.
+	//
+	// An expired session is passed to OnSessionExpired and then to
+	// OnSessionDestroyed, both with the reason it expired. Use
+	// OnSessionDestroyed to clean up after every session that ends.
+	OnSessionCreated   func(session *Session, reason SessionReason)
+	OnSessionExpired   func(session *Session, reason SessionReason)
+	OnSessionDestroyed func(session *Session, reason SessionReason)
+	OnSessionCommitted func(session *Session, reason SessionReason)
+
+	// SessionIndexKeys lists the session keys, such as "user_id", that
+	// Server.SessionsBy looks up in an index instead of going through
+	// every session. It must be set before Run.
+	SessionIndexKeys []string
 
 	// Preprocessor is called before a Route's handler is executed.
 	//
 	// If the returned Response is not nil, the handler is NOT executed,
 	// and the Response of the Preprocessor is written instead.
-	Preprocessor            func(request Request) *Response
+	Preprocessor func(request Request) *Response
+
+	// Postprocessor is called with every Response of a Route's handler or
+	// the Preprocessor before it is written, and returns the Response to
+	// write instead. Templates are already rendered at this point.
+	//
+	// Use Response.Kind to tell redirects, served files, streams and
+	// upgrades apart. Headers and cookies are sent for every kind. The
+	// status code and content type apply to plain, stream and serve
+	// responses, with two exceptions: a served file with a status other
+	// than 200 is sent whole, without Range or conditional handling, and
+	// a redirect ignores the content type. Upgrades always answer 101
+	// and ignore both.
+	Postprocessor func(request Request, response Response) Response
+
 	NotFoundHandler         func(request Request) Response
 	MethodNotAllowedHandler func(request Request) Response
+	PayloadTooLargeHandler  func(request Request) Response
 
-	routes   map[int][]*Route // int = length
-	sessions map[string]*Session
+	routes         map[int][]*Route // int = length
+	sessions       *sessionRegistry
+	sessionIndex   *sessionIndex
+	trustedProxies []netip.Prefix
+	tickHandlers   []func()
+
+	sessionStoreOnce sync.Once
 }
 
 // NewStandardConfiguration returns a default ServerConfiguration.
@@ -52,6 +148,11 @@ func NewStandardConfiguration() ServerConfiguration {
 		StaticUrl:  "/static",
 		CompassDir: ".compass",
 
+		MaxBodySize: 32 << 20, // 32MB
+
+		Compression:        true,
+		CompressionMinSize: 1024,
+
 		SessionExpiryTime:   3 * 24 * 60 * 60 * 1000, // 72 hours
 		SessionTickInterval: 5 * 60 * 1000,           // 5 minutes
 	}
@@ -79,10 +180,30 @@ func (c ServerConfiguration) CheckValidity() string {
 		rv += "compass directory value is empty;"
 	}
 
+	if _, invalid := parseTrustedProxies(c.TrustedProxies); len(invalid) > 0 {
+		rv += fmt.Sprintf("trusted proxies contain invalid CIDR ranges: %s;", strings.Join(invalid, ", "))
+	}
+
+	if c.MaxBodySize < 0 {
+		rv += "max body size must not be negative;"
+	}
+
+	if c.CompressionMinSize < 0 {
+		rv += "compression min size must not be negative;"
+	}
+
+	if c.ETags != ETagsOff && c.ETags != ETagsStrong && c.ETags != ETagsWeak {
+		rv += "etags must be empty, strong or weak;"
+	}
+
 	if c.SessionExpiryTime < 1 {
 		rv += "session expiry time must be above zero;"
 	}
 
+	if c.SessionMaxLifetime < 0 {
+		rv += "session max lifetime must not be negative;"
+	}
+
 	if c.SessionTickInterval < 1 {
 		rv += "session tick interval must be above zero;"
 	}
@@ -93,96 +214,175 @@ func (c ServerConfiguration) CheckValidity() string {
 // NewServer creates a new Server instance using the given configuration.
 //
 // The server is initialized with a default logger, a no-op alert handler,
-// and an empty route registry. The configuration is not validated here.
+// a template engine, and an empty route registry. The configuration is not
+// validated here.
 func NewServer(config ServerConfiguration) *Server {
-	return &Server{
+	s := &Server{
 		Config:       config,
 		Logger:       NewSimpleLogger(),
 		AlertHandler: func(err error) {},
+		Encoders:     defaultEncoders(),
+		StaticCache:  defaultStaticCache,
+
+		OnSessionCreated:   func(session *Session, reason SessionReason) {},
+		OnSessionExpired:   func(session *Session, reason SessionReason) {},
+		OnSessionDestroyed: func(session *Session, reason SessionReason) {},
+		OnSessionCommitted: func(session *Session, reason SessionReason) {},
 
 		Preprocessor: func(request Request) *Response {
 			return nil
 		},
+		Postprocessor: func(request Request, response Response) Response {
+			return response
+		},
 		NotFoundHandler: func(r Request) Response {
 			return HTMLWithCode(fmt.Sprintf("<html><h1>Not Found</h1><p>The requested route %s was not found on this server.</p></html>", r.URL.Path), http.StatusNotFound)
 		},
 		MethodNotAllowedHandler: func(r Request) Response {
 			return HTMLWithCode("<html><h1>Method not allowed</h1><p>The method is not allowed for the requested URL.</p></html>", http.StatusMethodNotAllowed)
 		},
+		PayloadTooLargeHandler: func(r Request) Response {
+			return HTMLWithCode("<html><h1>Payload Too Large</h1><p>The request body exceeds the size allowed for the requested URL.</p></html>", http.StatusRequestEntityTooLarge)
+		},
 
-		routes:   make(map[int][]*Route),
-		sessions: make(map[string]*Session),
+		routes:       make(map[int][]*Route),
+		sessions:     newSessionRegistry(),
+		sessionIndex: newSessionIndex(),
 	}
+
+	s.Templates = newTemplateEngine(s)
+	return s
 }
 
-// doManageSessionLifetimes starts a ticker for 5 minutes that checks the
-// LastAccess of each loaded session. If the session is found to be expired,
-// it is destroyed.
+// doManageSessionLifetimes starts a ticker that calls reapSessions every
+// SessionTickInterval.
+//
+// After the sessions, every function registered with onTick is called, so
+// other features can expire their state on the same schedule.
 //
 // This method is called after config validation in Run.
 func (s *Server) doManageSessionLifetimes() {
 	for range time.Tick(time.Duration(s.Config.SessionTickInterval) * time.Millisecond) {
-		destroyedSessions := make([]*Session, 0)
+		s.reapSessions()
 
-		for _, session := range s.sessions {
-			if time.Now().UnixMilli()-session.LastAccess > int64(s.Config.SessionExpiryTime) {
-				session.MustDestroy()
-			}
+		for _, handler := range s.tickHandlers {
+			handler()
+		}
+	}
+}
 
-			if session.destroyed {
-				destroyedSessions = append(destroyedSessions, session)
-			}
+// reapSessions checks the LastAccess and age of each loaded session. If the
+// session is found to be expired, it is destroyed. Destroyed sessions are
+// deleted from the SessionStore, the others have their LastAccess written
+// to it.
+func (s *Server) reapSessions() {
+	destroyedSessions := make([]*Session, 0)
+
+	for _, session := range s.sessions.all() {
+		if reason, ok := session.expiry(time.Now().UnixMilli()); ok && !session.IsDestroyed() {
+			s.OnSessionExpired(session, reason)
+			session.mustDestroy(reason)
 		}
 
-		for _, session := range destroyedSessions {
-			os.Remove(session.filePath())
-			delete(s.sessions, session.ID())
+		if session.IsDestroyed() {
+			destroyedSessions = append(destroyedSessions, session)
+			continue
 		}
-	}
-}
 
-// loadSessionsFromDisk walks all files in s.Config.CompassDir/session/ and attempts to
-// parse all JSON files as sessions.
-func (s *Server) loadSessionsFromDisk() error {
-	var files []string
-	root := filepath.Join(s.Config.CompassDir, "session")
-	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
-		if d == nil {
-			return nil
+		if err := session.touch(); err != nil {
+			s.Logger.Warn(err.Error())
 		}
+	}
 
-		if d.IsDir() {
-			return nil
+	for _, session := range destroyedSessions {
+		if err := s.sessionStore().Delete(session.ID()); err != nil {
+			s.Logger.Warn(err.Error())
 		}
+		s.sessions.delete(session)
+		s.sessionIndex.remove(session)
+	}
+}
 
-		if strings.HasSuffix(path, ".json") {
-			files = append(files, d.Name())
-			return nil
+// onTick registers a function that is called on every tick of
+// doManageSessionLifetimes. It must be called before Run.
+func (s *Server) onTick(handler func()) {
+	s.tickHandlers = append(s.tickHandlers, handler)
+}
+
+// sessionStore returns the SessionStore, setting up the default
+// FileSessionStore on the first call if none was set. A LogSessionStore
+// without an AlertHandler reports failed compactions to the server's.
+func (s *Server) sessionStore() SessionStore {
+	s.sessionStoreOnce.Do(func() {
+		if s.SessionStore == nil {
+			s.SessionStore = NewFileSessionStore(filepath.Join(s.Config.CompassDir, "session"))
 		}
 
-		return nil
+		if store, ok := s.SessionStore.(*LogSessionStore); ok {
+			store.alertTo(func(err error) {
+				s.Logger.Error(err.Error())
+				s.AlertHandler(err)
+			})
+		}
 	})
 
+	return s.SessionStore
+}
+
+// loadSessions loads every session in the SessionStore.
+//
+// Sessions whose id is not a UUID or that fail to load are skipped with a
+// warning, so one broken session doesn't keep the others from loading.
+// Corrupt sessions are also reported to the AlertHandler and quarantined
+// if the store implements SessionQuarantiner, so they are not loaded
+// again.
+func (s *Server) loadSessions() error {
+	ids, err := s.sessionStore().List()
 	if err != nil {
-		return fmt.Errorf("failed to load sessions from disk: %w", err)
+		return fmt.Errorf("failed to load sessions: %w", err)
 	}
 
-	for _, file := range files {
-		name := strings.TrimSuffix(file, ".json")
+	for _, name := range ids {
+		id, err := uuid.Parse(name)
+		if err != nil {
+			s.Logger.Warn(fmt.Sprintf("Skipping session %q: not a valid session id", name))
+			continue
+		}
+
+		session := newSession(s, id)
+		if err = session.reload(); errors.Is(err, ErrSessionCorrupt) {
+			s.quarantineSession(name, err)
+			continue
+		}
 
-		session := &Session{
-			server:  s,
-			id:      uuid.MustParse(name),
-			rwMutex: sync.RWMutex{},
-			data:    make(map[string]json.RawMessage),
+		if err != nil {
+			s.Logger.Warn(fmt.Sprintf("Skipping session %s: %v", name, err))
+			continue
 		}
-		session.reloadFromDisk()
-		s.sessions[name] = session
+
+		s.sessions.put(session)
 	}
 
 	return nil
 }
 
+// quarantineSession reports a corrupt session and moves it out of the way,
+// if the store supports that.
+func (s *Server) quarantineSession(id string, cause error) {
+	err := fmt.Errorf("corrupt session %s: %w", id, cause)
+
+	if quarantiner, ok := s.sessionStore().(SessionQuarantiner); ok {
+		if qErr := quarantiner.Quarantine(id); qErr != nil {
+			err = errors.Join(err, qErr)
+		} else {
+			err = fmt.Errorf("%w, moved it to quarantine", err)
+		}
+	}
+
+	s.Logger.Warn(err.Error())
+	s.AlertHandler(err)
+}
+
 // Run starts the HTTP server.
 //
 // It first validates the configuration and returns an error if invalid.
@@ -198,7 +398,9 @@ func (s *Server) Run() error {
 		return fmt.Errorf("config invalid: %s", configValidity)
 	}
 
-	err := s.loadSessionsFromDisk()
+	s.trustedProxies, _ = parseTrustedProxies(s.Config.TrustedProxies)
+
+	err := s.loadSessions()
 	if err != nil {
 		s.Logger.Error(err.Error())
 		s.AlertHandler(err)
@@ -208,8 +410,21 @@ func (s *Server) Run() error {
 	s.Logger.Info(fmt.Sprintf("Server is listening on :%d", s.Config.Port))
 	http.HandleFunc(
 		"/", func(w http.ResponseWriter, r *http.Request) {
+			r = s.resolveClient(r)
+
+			if s.Config.Compression {
+				cw := s.newCompressWriter(w, r)
+				defer func() {
+					if err := cw.close(); err != nil {
+						s.Logger.Error(fmt.Sprintf("failed to finish compressed response: %v", err))
+					}
+				}()
+				w = cw
+			}
+
 			request := NewRequestFromHttp(r)
 			request.Route = s.FindRoute(r.URL.Path)
+			request.server = s
 
 			if strings.HasPrefix(request.URL.Path, s.Config.StaticUrl) {
 				err := s.writeStatic(w, request, s.Config.AssetDir, strings.TrimPrefix(filepath.Clean(request.URL.Path), s.Config.StaticUrl))
@@ -244,7 +459,8 @@ func (s *Server) MustRun() {
 //
 // The target path is resolved relative to "<assetDir>/static".
 // If the file does not exist, a 404 response is returned.
-// On success, the file is served using http.ServeContent.
+// On success, the file is served using http.ServeContent with the
+// Cache-Control header of the StaticCache policy.
 func (s *Server) writeStatic(w http.ResponseWriter, request Request, assetDir string, target string) error {
 	path := filepath.Join(assetDir, "static", target)
 
@@ -264,6 +480,10 @@ func (s *Server) writeStatic(w http.ResponseWriter, request Request, assetDir st
 		return err
 	}
 
+	if policy := s.StaticCache(target).String(); policy != "" {
+		w.Header().Set("Cache-Control", policy)
+	}
+
 	s.Logger.Request(request.Http, http.StatusOK)
 	http.ServeContent(w, request.Http, target, stat.ModTime(), file)
 	return nil
@@ -272,10 +492,16 @@ func (s *Server) writeStatic(w http.ResponseWriter, request Request, assetDir st
 // write writes raw byte data to the response with a given status code.
 //
 // It also logs the request. If writing fails, an error is returned.
+// Empty bodies are not written at all, because statuses like 204 and 304
+// do not allow a body.
 func (s *Server) write(w http.ResponseWriter, r *http.Request, data []byte, status int) error {
 	s.Logger.Request(r, status)
 
 	w.WriteHeader(status)
+	if len(data) == 0 {
+		return nil
+	}
+
 	_, err := w.Write(data)
 	if err != nil {
 		return fmt.Errorf("failed to write byte data for status %d: %v", status, err)
@@ -298,10 +524,10 @@ func (s *Server) writeError(w http.ResponseWriter, r *http.Request, err error) {
 	w.Write([]byte("There was an internal server error. Try again later."))
 }
 
-// CreateSession creates a new session, writes it to disk, and registers
-// it in the server's session map.
+// CreateSession creates a new session, saves it to the SessionStore, and
+// registers it in the server's session map. With SessionCookieKeys, it is
+// kept in the response's cookies instead.
 //
-// The session directory is created if it does not already exist.
 // The caller is responsible for attaching the session cookie to the
 // response using response.SetSession
 //
@@ -317,17 +543,11 @@ func (s *Server) CreateSession() (*Session, error) {
 		return nil, fmt.Errorf("failed to generate session id: %w", err)
 	}
 
-	dir := filepath.Join(s.Config.CompassDir, "session")
-	if err = os.MkdirAll(dir, 0755); err != nil {
-		return nil, fmt.Errorf("failed to create session directory: %w", err)
-	}
-
-	session := &Session{
-		server:     s,
-		id:         id,
-		LastAccess: time.Now().UnixMilli(),
-		rwMutex:    sync.RWMutex{},
-		data:       make(map[string]json.RawMessage),
+	var session *Session
+	if s.SessionCookieKeys != nil {
+		session = s.newCookieSession(id, SessionRecord{})
+	} else {
+		session = newSession(s, id)
 	}
 
 	session.rwMutex.Lock()
@@ -335,10 +555,14 @@ func (s *Server) CreateSession() (*Session, error) {
 	session.rwMutex.Unlock()
 
 	if err != nil {
-		return nil, fmt.Errorf("failed to write initial session file: %w", err)
+		return nil, fmt.Errorf("failed to save new session: %w", err)
+	}
+
+	if session.cookieStore == nil {
+		s.sessions.put(session)
 	}
 
-	s.sessions[session.ID()] = session
+	s.OnSessionCreated(session, SessionReasonCreated)
 	return session, nil
 }
 
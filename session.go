@@ -2,57 +2,195 @@ package compass
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/google/uuid"
-	"os"
-	"path/filepath"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// Session represents an active user session backed by a JSON file on disk.
+// sessionCookieName is the cookie that identifies the session of a client,
+// or holds it for cookie sessions.
+const sessionCookieName = "_compassId"
+
+// Session represents an active user session, kept in the server's
+// SessionStore or, with Server.SessionCookieKeys, in the client's cookie.
 //
 // Values are stored as raw JSON internally, so any JSON-serialisable type
 // can be stored. Use SessionGet to retrieve typed values, and BeginTx to
 // make changes.
 //
-// Sessions are safe for concurrent reads. Writes must go through a
+// Sessions are safe for concurrent use. Writes must go through a
 // SessionTransaction and be finalised with Commit.
 type Session struct {
 	server *Server
 
-	id         uuid.UUID
-	LastAccess int64
+	id         atomic.Pointer[uuid.UUID]
+	lastAccess atomic.Int64 // UnixMilli
+	destroyed  atomic.Bool
+
+	rwMutex     sync.RWMutex
+	version     int64 // store version at last load or save, see SessionVersioner
+	savedAccess int64 // lastAccess as last written to the store
+	data        map[string]json.RawMessage
+
+	// Lifetime of the session, see sessiontimeout.go. The timeouts are
+	// zero if the server's apply.
+	createdAt   int64 // UnixMilli
+	idleTimeout int64 // milliseconds
+	maxLifetime int64 // milliseconds
+
+	// cookieSent is when the session cookie was last sent, in UnixMilli,
+	// so its expiry is only refreshed once per tick.
+	cookieSent atomic.Int64
+
+	// cookieStore holds cookie sessions instead of the server's
+	// SessionStore, see cookiesession.go. It is nil for other sessions.
+	cookieStore *cookieSessionStore
+}
+
+// newSession creates an empty, unsaved session.
+func newSession(server *Server, id uuid.UUID) *Session {
+	session := &Session{
+		server:  server,
+		rwMutex: sync.RWMutex{},
+		data:    make(map[string]json.RawMessage),
+	}
 
-	rwMutex      sync.RWMutex
-	lastModified int64 // mtime of the file at last load, in UnixNano
-	destroyed    bool
-	data         map[string]json.RawMessage
+	session.id.Store(&id)
+	return session
 }
 
 // ID returns the session identifier as a UUID string.
 //
 // This value is stored in the client's _compassId cookie and used
-// as the session's filename on disk.
+// as the session's key in the SessionStore. It changes when the
+// session is regenerated.
 func (s *Session) ID() string {
-	return s.id.String()
+	return s.id.Load().String()
+}
+
+// Regenerate moves the session to a new, random id. The data stays the
+// same, but the old id is no longer valid.
+//
+// Call it whenever the privileges of a session change, most importantly
+// after login, so an id that was planted in the client's browser before
+// (session fixation) or leaked from a lower-privileged state is useless.
+// The response must carry the new cookie, see Response.RegenerateSession.
+//
+// The move is atomic if the store implements SessionRenamer. Otherwise the
+// session is saved under the new id before the old one is deleted.
+func (s *Session) Regenerate() error {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return fmt.Errorf("failed to generate session id: %w", err)
+	}
+
+	if err = s.regenerate(id); err != nil {
+		return err
+	}
+
+	s.server.OnSessionCommitted(s, SessionReasonRegenerated)
+	return nil
+}
+
+// regenerate moves the session to the given id under the write lock.
+func (s *Session) regenerate(id uuid.UUID) error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	if s.destroyed.Load() {
+		return fmt.Errorf("cannot regenerate destroyed session %s", s.ID())
+	}
+
+	oldID := s.ID()
+	newID := id.String()
+
+	var err error
+	store := s.store()
+	if renamer, ok := store.(SessionRenamer); ok {
+		err = renamer.Rename(oldID, newID)
+	} else {
+		err = store.Save(newID, s.record(s.lastAccess.Load()))
+		if err == nil {
+			err = store.Delete(oldID)
+		}
+	}
+
+	if err != nil {
+		store.Delete(newID)
+		return fmt.Errorf("failed to regenerate session %s: %w", oldID, err)
+	}
+
+	s.id.Store(&id)
+	s.version = storeVersion(store, newID)
+	if s.cookieStore == nil {
+		s.server.sessions.move(s, oldID)
+	}
+	return nil
+}
+
+// MustRegenerate executes Regenerate, but any error that is thrown is forwarded to the AlertHandler.
+func (s *Session) MustRegenerate() {
+	err := s.Regenerate()
+	if err != nil {
+		s.server.Logger.Error(err.Error())
+		s.server.AlertHandler(err)
+	}
+}
+
+// LastAccess returns the time the session was last read or committed, in
+// UnixMilli. Sessions that are not accessed for
+// ServerConfiguration.SessionExpiryTime are destroyed.
+func (s *Session) LastAccess() int64 {
+	return s.lastAccess.Load()
+}
+
+// IsDestroyed reports whether Destroy was called on the session.
+func (s *Session) IsDestroyed() bool {
+	return s.destroyed.Load()
 }
 
 // Destroy marks the session for deletion.
 //
-// The session file is removed from disk and the client cookie is expired
-// when the response is written. Calling Commit on any transaction belonging
-// to a destroyed session is ignored.
+// The session is removed from the store on the next tick of the session
+// reaper. Calling Commit on any transaction belonging to a destroyed
+// session is ignored.
 //
-// Returns an error if we failed to dump the session data
+// Returns an error if we failed to save the session
 func (s *Session) Destroy() error {
-	s.destroyed = true
-	return s.dump()
+	return s.destroy(SessionReasonDestroyed)
+}
+
+// destroy marks the session as destroyed and saves it. OnSessionDestroyed
+// is called with the reason once the lock is released, unless the session
+// was destroyed before.
+func (s *Session) destroy(reason SessionReason) error {
+	s.rwMutex.Lock()
+	wasDestroyed := s.destroyed.Swap(true)
+	err := s.dump()
+	s.rwMutex.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	if !wasDestroyed {
+		s.server.OnSessionDestroyed(s, reason)
+	}
+
+	return nil
 }
 
 // MustDestroy executes Destroy, but any error that is thrown is forwarded to the AlertHandler.
 func (s *Session) MustDestroy() {
-	err := s.Destroy()
+	s.mustDestroy(SessionReasonDestroyed)
+}
+
+// mustDestroy is MustDestroy with a reason for OnSessionDestroyed.
+func (s *Session) mustDestroy(reason SessionReason) {
+	err := s.destroy(reason)
 	if err != nil {
 		err = fmt.Errorf("failed to destroy session: %w", err)
 		s.server.Logger.Error(err.Error())
@@ -60,115 +198,185 @@ func (s *Session) MustDestroy() {
 	}
 }
 
-// filePath returns the absolute path of this session's JSON file on disk.
-func (s *Session) filePath() string {
-	return filepath.Join(s.server.Config.CompassDir, "session", s.ID()+".json")
-}
-
-// checkReload stats the session file and calls reloadFromDisk if the file
-// has been modified since the last load.
+// checkReload asks the store for the session's version and calls reload
+// if it has changed since the last load.
 //
-// The stat itself is done outside any lock. If a reload is needed, the write
-// lock is acquired inside reloadFromDisk. This means the common no
-// change case pays only the cost of a stat and a read lock check.
+// Only stores implementing SessionVersioner can change behind our back, so
+// for other stores this does nothing. The version check is done outside
+// any lock. If a reload is needed, the write lock is acquired inside
+// reload. This means the common no change case pays only the cost of the
+// version check and a read lock.
 func (s *Session) checkReload() {
-	info, err := os.Stat(s.filePath())
-	if err != nil {
+	versioner, ok := s.store().(SessionVersioner)
+	if !ok {
 		return
 	}
 
-	mtime := info.ModTime().UnixNano()
+	version, err := versioner.Version(s.ID())
+	if err != nil {
+		return
+	}
 
 	s.rwMutex.RLock()
-	needsReload := mtime != s.lastModified
+	needsReload := version != s.version
 	s.rwMutex.RUnlock()
 
 	if needsReload {
-		s.reloadFromDisk()
+		if err = s.reload(); err != nil {
+			s.reloadFailed(err)
+		}
 	}
 }
 
-// reloadFromDisk reads the session file from disk and replaces the in-memory
-// data with its contents.
-//
-// If the file cannot be read or parsed, the existing in-memory data is left
-// unchanged. The write lock is held for the duration of the reload.
-//
-// This is called automatically by SessionGet when the file's mtime has
-// changed since the last load, allowing external modifications, such as
-// those made by another server instance, to be picked up transparently.
-func (s *Session) reloadFromDisk() {
-	unlocked := false // cursed
+// reloadFailed handles a session that changed in the store, but can't be
+// loaded anymore. A corrupt one is quarantined and destroyed, since its
+// data can't be trusted and saving the old data over it would hide the
+// problem. For other errors, like a failed read, the data in memory is
+// kept and the error is logged.
+func (s *Session) reloadFailed(err error) {
+	if !errors.Is(err, ErrSessionCorrupt) {
+		s.server.Logger.Warn(fmt.Sprintf("failed to reload session %s: %v", s.ID(), err))
+		return
+	}
+
+	s.server.quarantineSession(s.ID(), err)
 
 	s.rwMutex.Lock()
-	defer func() { // very cursed stuff here
-		if unlocked {
-			return
-		}
-		unlocked = true
-		s.rwMutex.Unlock()
-	}()
+	wasDestroyed := s.destroyed.Swap(true)
+	s.rwMutex.Unlock()
 
-	info, err := os.Stat(s.filePath())
-	if err != nil {
-		return
+	if !wasDestroyed {
+		s.server.sessionIndex.remove(s)
+		s.server.OnSessionDestroyed(s, SessionReasonCorrupt)
 	}
+}
+
+// reload loads the session from the store and replaces the in-memory
+// data with it.
+//
+// If the session cannot be loaded, the existing in-memory data is left
+// unchanged and the error is returned. The write lock is held for the
+// duration of the reload.
+//
+// This is called automatically by SessionGet when the store reports a new
+// version, allowing external modifications, such as those made by another
+// server instance, to be picked up transparently.
+func (s *Session) reload() error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
 
-	raw, err := os.ReadFile(s.filePath())
+	store := s.store()
+	record, err := store.Load(s.ID())
 	if err != nil {
-		return
+		return err
 	}
 
-	var newData map[string]json.RawMessage
-	if err := json.Unmarshal(raw, &newData); err != nil {
-		return
+	s.data = record.Data
+	s.lastAccess.Store(record.LastAccess)
+	s.savedAccess = record.LastAccess
+	s.destroyed.Store(record.Destroyed)
+	s.idleTimeout = record.IdleTimeout
+	s.maxLifetime = record.MaxLifetime
+
+	// Sessions stored before CreatedAt existed are at least as old as
+	// their last access.
+	s.createdAt = record.CreatedAt
+	if s.createdAt == 0 {
+		s.createdAt = record.LastAccess
 	}
 
-	s.data = newData
-	s.lastModified = info.ModTime().UnixNano()
-
-	s.rwMutex.Unlock()
-	unlocked = true // the most curserest
-	s.LastAccess = SessionGetOrDefault(s, "--COMPASS-Last-Access", s.lastModified)
-	s.destroyed = SessionGetOrDefault(s, "--COMPASS-Destroyed", false)
+	s.version = storeVersion(store, s.ID())
+	s.index()
+	return nil
 }
 
-// dump serialises the session's current data map to disk.
+// dump saves the session's current data to the store.
 //
-// It must be called with the write lock already held. After a successful
-// write, lastModified is updated to match the file's new mtime so that
-// the next checkReload does not trigger a redundant reload.
+// It must be called with the write lock already held. A save counts as an
+// access. After a successful save, version is updated so that the next
+// checkReload does not trigger a redundant reload.
 func (s *Session) dump() error {
-	wdat := s.data
-	b, _ := json.Marshal(time.Now().UnixMilli())
-	wdat["--COMPASS-Last-Access"] = b
-	b, _ = json.Marshal(s.destroyed)
-	wdat["--COMPASS-Destroyed"] = b
+	now := time.Now().UnixMilli()
+
+	if s.createdAt == 0 {
+		s.createdAt = now
+	}
 
-	data, err := json.Marshal(wdat)
+	store := s.store()
+	err := store.Save(s.ID(), s.record(now))
 	if err != nil {
-		return fmt.Errorf("failed to marshal during commit of session %s: %w", s.ID(), err)
+		return fmt.Errorf("failed to save session %s: %w", s.ID(), err)
 	}
 
-	path := s.filePath()
-	if err = os.WriteFile(path, data, 0644); err != nil {
-		return fmt.Errorf("failed to write during commit of session %s: %w", s.ID(), err)
+	s.lastAccess.Store(now)
+	s.savedAccess = now
+
+	// Update version so checkReload does not immediately reload just written session!!!!!!!!!!!!!!!!
+	s.version = storeVersion(store, s.ID())
+	s.index()
+	return nil
+}
+
+// record returns the stored form of the session with the given last
+// access time. It must be called with the lock held.
+func (s *Session) record(lastAccess int64) SessionRecord {
+	return SessionRecord{
+		Data:        s.data,
+		LastAccess:  lastAccess,
+		Destroyed:   s.destroyed.Load(),
+		CreatedAt:   s.createdAt,
+		IdleTimeout: s.idleTimeout,
+		MaxLifetime: s.maxLifetime,
 	}
+}
 
-	// Update lastModified so checkReload does not immediately reload just written file!!!!!!!!!!!!!!!!
-	info, err := os.Stat(path)
-	if err != nil {
-		return fmt.Errorf("failed to stat after commit of session %s: %w", s.ID(), err)
+// touch writes the last access time to the store if it changed since the last save,
+// so it survives a restart without rewriting the whole session on every
+// read. It is called by the session reaper.
+func (s *Session) touch() error {
+	s.rwMutex.Lock()
+	defer s.rwMutex.Unlock()
+
+	lastAccess := s.lastAccess.Load()
+	if s.destroyed.Load() || lastAccess == s.savedAccess {
+		return nil
+	}
+
+	store := s.store()
+	if err := store.Touch(s.ID(), lastAccess); err != nil {
+		return fmt.Errorf("failed to touch session %s: %w", s.ID(), err)
 	}
-	s.lastModified = info.ModTime().UnixNano()
 
+	s.savedAccess = lastAccess
+	s.version = storeVersion(store, s.ID())
 	return nil
 }
 
+// store returns the store the session is kept in.
+func (s *Session) store() SessionStore {
+	if s.cookieStore != nil {
+		return s.cookieStore
+	}
+
+	return s.server.sessionStore()
+}
+
+// storeVersion returns the version of a session if the store implements
+// SessionVersioner, and 0 otherwise.
+func storeVersion(store SessionStore, id string) int64 {
+	versioner, ok := store.(SessionVersioner)
+	if !ok {
+		return 0
+	}
+
+	version, _ := versioner.Version(id)
+	return version
+}
+
 // SessionGet retrieves and deserializes a value from the session by key.
 //
-// The file is reloaded from disk first if its mtime has changed since the
-// last load. If the key does not exist, or deserialisation fails, a non-nil
+// The session is reloaded first if the store reports that it has changed
+// since the last load. If the key does not exist, or deserialisation fails, a non-nil
 // error is returned and the zero value of T is returned.
 //
 // Example:
@@ -191,7 +399,7 @@ func SessionGet[T any](s *Session, key string) (T, error) {
 		return zero, fmt.Errorf("failed to unmarshal key %q of session %s: %w", key, s.ID(), err)
 	}
 
-	s.LastAccess = time.Now().UnixMilli()
+	s.lastAccess.Store(time.Now().UnixMilli())
 	return result, nil
 }
 
@@ -212,14 +420,20 @@ func SessionGetOrDefault[T any](s *Session, key string, fallback T) T {
 
 // SessionTransaction holds a set of pending changes to a Session.
 //
-// Changes are not applied to the session or written to disk until Commit
-// is called. A nil value in the changes map signals that the key should
+// Changes are not applied to the session or written to the store until
+// Commit is called. A nil value in the changes map signals that the key should
 // be deleted from the session.
 //
 // Create a transaction with Session.BeginTx.
 type SessionTransaction struct {
 	session *Session
 	changes map[string]*json.RawMessage
+	flashes []Flash
+
+	// Staged timeouts in milliseconds, nil if unchanged. See
+	// sessiontimeout.go.
+	idleTimeout *int64
+	maxLifetime *int64
 }
 
 // BeginTx creates a new SessionTransaction for this session.
@@ -233,28 +447,50 @@ func (s *Session) BeginTx() *SessionTransaction {
 	}
 }
 
+// cookie returns the cookie carrying the session id. It expires with the
+// session, see cookieExpiry.
 func (s *Session) cookie() Cookie {
+	now := time.Now().UnixMilli()
+	maxAge, expires := s.cookieExpiry(now)
+	s.cookieSent.Store(now)
+
 	return Cookie{
-		Name:     "_compassId",
+		Name:     sessionCookieName,
 		Value:    s.ID(),
+		MaxAge:   maxAge,
+		Expires:  expires,
 		HttpOnly: true,
 		SameSite: SameSiteLax,
 		Path:     "/",
 	}
 }
 
-// Commit applies all staged changes to the session and writes it to disk.
+// Commit applies all staged changes to the session and saves it to the
+// store.
 //
-// The write lock is held for the duration of the apply and the disk write.
+// The write lock is held for the duration of the apply and the save.
 // If the session has been destroyed, Commit is ignored and returns nil.
+// Otherwise, OnSessionCommitted is called after a successful save.
 func (tx *SessionTransaction) Commit() error {
-	if tx.session.destroyed {
-		return nil
+	committed, err := tx.commit()
+	if err != nil || !committed {
+		return err
 	}
 
+	tx.session.server.OnSessionCommitted(tx.session, SessionReasonCommit)
+	return nil
+}
+
+// commit applies and saves the changes under the write lock. committed is
+// false if the session was destroyed.
+func (tx *SessionTransaction) commit() (committed bool, err error) {
 	tx.session.rwMutex.Lock()
 	defer tx.session.rwMutex.Unlock()
 
+	if tx.session.destroyed.Load() {
+		return false, nil
+	}
+
 	for k, v := range tx.changes {
 		if v == nil {
 			delete(tx.session.data, k)
@@ -263,7 +499,27 @@ func (tx *SessionTransaction) Commit() error {
 		tx.session.data[k] = *v
 	}
 
-	return tx.session.dump()
+	if len(tx.flashes) > 0 {
+		if err := tx.session.appendFlashes(tx.flashes); err != nil {
+			return false, err
+		}
+	}
+
+	if tx.idleTimeout != nil {
+		tx.session.idleTimeout = *tx.idleTimeout
+	}
+
+	if tx.maxLifetime != nil {
+		tx.session.maxLifetime = *tx.maxLifetime
+	}
+
+	// The cookie's expiry is out of date now, so the response should
+	// carry a new one.
+	if tx.idleTimeout != nil || tx.maxLifetime != nil {
+		tx.session.cookieSent.Store(0)
+	}
+
+	return true, tx.session.dump()
 }
 
 // Set stages a value to be written to the session under the given key.
@@ -0,0 +1,125 @@
+package compass
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+)
+
+// sessionAdminEntry is one session in the listing of SessionAdminHandler.
+type sessionAdminEntry struct {
+	Ref        string                     `json:"ref"`
+	CreatedAt  int64                      `json:"created_at"`
+	LastAccess int64                      `json:"last_access"`
+	ExpiresAt  int64                      `json:"expires_at"`
+	Indexed    map[string]json.RawMessage `json:"indexed,omitempty"`
+}
+
+// SessionAdminHandler returns a route handler to list and revoke the live
+// sessions of the server as JSON. Mount it wherever you like, and allow
+// DELETE to revoke sessions:
+//
+//	route := server.AddRoute("/admin/sessions", server.SessionAdminHandler(isAdmin))
+//	route.AllowedMethods = []string{"get", "delete"}
+//
+// Requests that authorize rejects get a 403. A nil authorize rejects
+// every request.
+//
+// GET lists the sessions, most recently accessed first, with their
+// creation, last access and expiry time in UnixMilli and the values of
+// Server.SessionIndexKeys. Sessions are identified by a ref derived from
+// their id, since the id itself would let whoever reads the listing take
+// over the session.
+//
+// DELETE revokes sessions, either one by ?ref=..., or all that hold a
+// value under a key by ?key=user_id&value=42. The value is JSON, so
+// strings are quoted. It needs a valid CSRF token, see VerifyCSRF, and
+// responds with the number of revoked sessions.
+func (s *Server) SessionAdminHandler(authorize func(request Request) bool) func(request Request) Response {
+	return func(request Request) Response {
+		if authorize == nil || !authorize(request) {
+			return TextWithCode("Forbidden", http.StatusForbidden)
+		}
+
+		switch request.Method {
+		case "get", "head":
+			return JsonMarshal(s.sessionAdminList())
+		case "delete":
+			return s.sessionAdminRevoke(request)
+		default:
+			return s.MethodNotAllowedHandler(request)
+		}
+	}
+}
+
+// sessionAdminList returns the live sessions for the listing of
+// SessionAdminHandler.
+func (s *Server) sessionAdminList() []sessionAdminEntry {
+	entries := make([]sessionAdminEntry, 0)
+	for _, session := range s.Sessions() {
+		entries = append(entries, sessionAdminEntry{
+			Ref:        sessionRef(session.ID()),
+			CreatedAt:  session.CreatedAt(),
+			LastAccess: session.LastAccess(),
+			ExpiresAt:  session.ExpiresAt(),
+			Indexed:    s.sessionIndex.get(session),
+		})
+	}
+
+	slices.SortFunc(entries, func(a, b sessionAdminEntry) int {
+		return cmp.Compare(b.LastAccess, a.LastAccess)
+	})
+
+	return entries
+}
+
+// sessionAdminRevoke handles a DELETE of SessionAdminHandler.
+func (s *Server) sessionAdminRevoke(request Request) Response {
+	if !request.VerifyCSRF() {
+		return TextWithCode("Invalid CSRF token", http.StatusForbidden)
+	}
+
+	query := request.Http.URL.Query()
+
+	var sessions []*Session
+	switch {
+	case query.Has("ref"):
+		ref := query.Get("ref")
+		for _, session := range s.Sessions() {
+			if sessionRef(session.ID()) == ref {
+				sessions = append(sessions, session)
+			}
+		}
+	case query.Has("key") && query.Has("value"):
+		value := json.RawMessage(query.Get("value"))
+		if !json.Valid(value) {
+			return TextWithCode("value must be JSON", http.StatusBadRequest)
+		}
+
+		var err error
+		sessions, err = s.SessionsBy(query.Get("key"), value)
+		if err != nil {
+			return TextWithCode(err.Error(), http.StatusBadRequest)
+		}
+	default:
+		return TextWithCode("Expected ref, or key and value", http.StatusBadRequest)
+	}
+
+	n, err := s.revokeSessions(sessions)
+	if err != nil {
+		s.Logger.Error(err.Error())
+		s.AlertHandler(err)
+	}
+
+	return JsonMarshal(map[string]int{"revoked": n})
+}
+
+// sessionRef returns the public reference of a session id used by
+// SessionAdminHandler. It can't be turned back into the id.
+func sessionRef(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return hex.EncodeToString(sum[:8])
+}
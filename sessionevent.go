@@ -0,0 +1,33 @@
+package compass
+
+// SessionReason tells a session hook why it was called. See
+// Server.OnSessionCreated and the other hooks.
+type SessionReason string
+
+const (
+	// SessionReasonCreated is passed to OnSessionCreated by CreateSession.
+	SessionReasonCreated SessionReason = "created"
+	// SessionReasonDestroyed is passed to OnSessionDestroyed by Destroy.
+	SessionReasonDestroyed SessionReason = "destroyed"
+	// SessionReasonIdle is passed to OnSessionExpired and
+	// OnSessionDestroyed if the idle timeout of a session ran out.
+	SessionReasonIdle SessionReason = "idle"
+	// SessionReasonMaxLifetime is passed to OnSessionExpired and
+	// OnSessionDestroyed if the max lifetime of a session ran out.
+	SessionReasonMaxLifetime SessionReason = "max_lifetime"
+	// SessionReasonCommit is passed to OnSessionCommitted by
+	// SessionTransaction.Commit.
+	SessionReasonCommit SessionReason = "commit"
+	// SessionReasonFlashes is passed to OnSessionCommitted by
+	// ConsumeFlashes, which removes the flashes from the session.
+	SessionReasonFlashes SessionReason = "flashes"
+	// SessionReasonRegenerated is passed to OnSessionCommitted by
+	// Regenerate. The session has its new id already.
+	SessionReasonRegenerated SessionReason = "regenerated"
+	// SessionReasonRevoked is passed to OnSessionDestroyed by
+	// Server.DestroySessionsBy and the session admin handler.
+	SessionReasonRevoked SessionReason = "revoked"
+	// SessionReasonCorrupt is passed to OnSessionDestroyed if the stored
+	// session changed and can't be loaded anymore, see ErrSessionCorrupt.
+	SessionReasonCorrupt SessionReason = "corrupt"
+)
@@ -0,0 +1,293 @@
+package compass
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// sessionIndex maps the values of Server.SessionIndexKeys to the sessions
+// holding them, so SessionsBy doesn't have to look at every session.
+//
+// Values are kept in their canonical JSON form, see canonicalJSON. The
+// index is updated by Session.dump and Session.reload with the session's
+// write lock held, so it takes the session lock first and its own second.
+// It never locks a session itself.
+type sessionIndex struct {
+	mutex    sync.RWMutex
+	sessions map[string]map[string]map[*Session]struct{} // key -> value -> sessions
+	values   map[*Session]map[string]string              // session -> key -> value
+}
+
+// newSessionIndex creates an empty sessionIndex.
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{
+		sessions: make(map[string]map[string]map[*Session]struct{}),
+		values:   make(map[*Session]map[string]string),
+	}
+}
+
+// update indexes the current values of the keys for a session, replacing
+// the ones indexed before. Keys the session doesn't have, or whose value
+// isn't valid JSON, are not indexed for it.
+func (i *sessionIndex) update(session *Session, keys []string, data map[string]json.RawMessage) {
+	values := make(map[string]string)
+	for _, key := range keys {
+		raw, ok := data[key]
+		if !ok {
+			continue
+		}
+
+		value, err := canonicalJSON(raw)
+		if err != nil {
+			continue
+		}
+
+		values[key] = value
+	}
+
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.unlink(session)
+	if len(values) == 0 {
+		return
+	}
+
+	i.values[session] = values
+	for key, value := range values {
+		byValue, ok := i.sessions[key]
+		if !ok {
+			byValue = make(map[string]map[*Session]struct{})
+			i.sessions[key] = byValue
+		}
+
+		if byValue[value] == nil {
+			byValue[value] = make(map[*Session]struct{})
+		}
+		byValue[value][session] = struct{}{}
+	}
+}
+
+// remove drops a session from the index.
+func (i *sessionIndex) remove(session *Session) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+
+	i.unlink(session)
+}
+
+// unlink drops a session from the index. It must be called with the write
+// lock held.
+func (i *sessionIndex) unlink(session *Session) {
+	for key, value := range i.values[session] {
+		byValue := i.sessions[key]
+		delete(byValue[value], session)
+		if len(byValue[value]) == 0 {
+			delete(byValue, value)
+		}
+	}
+
+	delete(i.values, session)
+}
+
+// lookup returns the sessions whose key has the given canonical value.
+func (i *sessionIndex) lookup(key string, value string) []*Session {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	var sessions []*Session
+	for session := range i.sessions[key][value] {
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// get returns the indexed values of a session, as raw JSON.
+func (i *sessionIndex) get(session *Session) map[string]json.RawMessage {
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+
+	if len(i.values[session]) == 0 {
+		return nil
+	}
+
+	values := make(map[string]json.RawMessage, len(i.values[session]))
+	for key, value := range i.values[session] {
+		values[key] = json.RawMessage(value)
+	}
+
+	return values
+}
+
+// canonicalJSON returns JSON in a form that is equal for equal values, no
+// matter the whitespace, key order or escaping it was written with. Numbers
+// are kept as written, so large ids don't lose precision.
+func canonicalJSON(raw []byte) (string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+
+	var value any
+	if err := decoder.Decode(&value); err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// indexed reports whether a session key is in Server.SessionIndexKeys.
+func (s *Server) indexed(key string) bool {
+	for _, k := range s.SessionIndexKeys {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Sessions returns a snapshot of the live sessions of the server, in no
+// particular order. Destroyed and expired sessions are left out, and
+// sessions created afterwards are not included.
+//
+// Cookie sessions are kept by the clients, so the server can't list them.
+// With Server.SessionCookieKeys set, this returns nothing.
+func (s *Server) Sessions() []*Session {
+	now := time.Now().UnixMilli()
+
+	var sessions []*Session
+	for _, session := range s.sessions.all() {
+		if session.IsDestroyed() || session.expired(now) {
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions
+}
+
+// SessionsBy returns the live sessions that hold the given value under the
+// session key, such as every session of one user:
+//
+//	sessions, err := server.SessionsBy("user_id", user.ID)
+//
+// Values are compared as JSON, so the value must marshal the same way as
+// the one passed to SessionTransaction.Set. Keys in
+// Server.SessionIndexKeys are looked up in an index, others by going
+// through every session.
+//
+// Like Sessions, this never returns cookie sessions.
+func (s *Server) SessionsBy(key string, value any) ([]*Session, error) {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal value for key %q: %w", key, err)
+	}
+
+	want, err := canonicalJSON(b)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal value for key %q: %w", key, err)
+	}
+
+	if !s.indexed(key) {
+		var sessions []*Session
+		for _, session := range s.Sessions() {
+			if session.holds(key, want) {
+				sessions = append(sessions, session)
+			}
+		}
+
+		return sessions, nil
+	}
+
+	now := time.Now().UnixMilli()
+
+	var sessions []*Session
+	for _, session := range s.sessionIndex.lookup(key, want) {
+		if session.IsDestroyed() || session.expired(now) {
+			continue
+		}
+
+		// The index is updated before a new session is registered. Until
+		// then, it isn't one of the server's.
+		if registered, ok := s.sessions.get(session.ID()); !ok || registered != session {
+			continue
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// DestroySessionsBy destroys every session returned by SessionsBy, e.g. to
+// log a user out everywhere after a password change. OnSessionDestroyed is
+// called for each with SessionReasonRevoked.
+//
+// It returns how many sessions were destroyed. Sessions that fail to save
+// are still marked as destroyed and can't be used anymore, the errors are
+// joined.
+func (s *Server) DestroySessionsBy(key string, value any) (int, error) {
+	sessions, err := s.SessionsBy(key, value)
+	if err != nil {
+		return 0, err
+	}
+
+	return s.revokeSessions(sessions)
+}
+
+// revokeSessions destroys sessions with SessionReasonRevoked and returns
+// how many were destroyed without an error.
+func (s *Server) revokeSessions(sessions []*Session) (int, error) {
+	var errs []error
+	n := 0
+	for _, session := range sessions {
+		if err := session.destroy(SessionReasonRevoked); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		n++
+	}
+
+	return n, errors.Join(errs...)
+}
+
+// holds reports whether the session has the canonical JSON value under the
+// key.
+func (s *Session) holds(key string, value string) bool {
+	s.rwMutex.RLock()
+	raw, ok := s.data[key]
+	s.rwMutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	have, err := canonicalJSON(raw)
+	return err == nil && have == value
+}
+
+// index updates the session's entry in the server's sessionIndex after its
+// data changed. It must be called with the write lock held. Cookie
+// sessions are not indexed, and destroyed ones are removed.
+func (s *Session) index() {
+	if s.cookieStore != nil || len(s.server.SessionIndexKeys) == 0 {
+		return
+	}
+
+	if s.destroyed.Load() {
+		s.server.sessionIndex.remove(s)
+		return
+	}
+
+	s.server.sessionIndex.update(s, s.server.SessionIndexKeys, s.data)
+}
@@ -0,0 +1,509 @@
+package compass
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// logCompactMin is the number of log entries below which LogSessionStore
+// never compacts. Rewriting a small file on every change isn't worth it.
+const logCompactMin = 1024
+
+// sealedLogContext is the KeyRing context of sealed log entries.
+var sealedLogContext = []byte("compass session log")
+
+// logEntry is one line of a LogSessionStore file.
+type logEntry struct {
+	Op         string                     `json:"op"` // "save", "touch", "rename" or "delete"
+	ID         string                     `json:"id"`
+	To         string                     `json:"to,omitempty"`
+	Data       map[string]json.RawMessage `json:"data,omitempty"`
+	LastAccess int64                      `json:"last_access,omitempty"`
+	Destroyed  bool                       `json:"destroyed,omitempty"`
+
+	CreatedAt   int64 `json:"created_at,omitempty"`
+	IdleTimeout int64 `json:"idle_timeout,omitempty"`
+	MaxLifetime int64 `json:"max_lifetime,omitempty"`
+}
+
+// LogSessionStore is a SessionStore that keeps all sessions in a single
+// append-only file, one JSON entry per change.
+//
+// Every change is a single append, so it doesn't slow down with the number
+// of sessions like a directory of files does. The current state is kept in
+// memory and rebuilt from the log on open. Once the log holds more than
+// twice as many entries as there are sessions, it is compacted by
+// rewriting it with one entry per session.
+//
+// Every append is synced to disk before it returns, so a saved session
+// survives a crash of the process or the machine.
+//
+// The file is only readable by the owner, but its entries are plaintext
+// unless the store was opened with NewLogSessionStoreWithKeys.
+//
+// Only one process may use a file at a time.
+type LogSessionStore struct {
+	// AlertHandler is called when an automatic compaction fails. The change
+	// that triggered it is saved already, so it isn't reported to the
+	// caller. The log just keeps growing until a later compaction works.
+	//
+	// The server sets it to log the error and call Server.AlertHandler if
+	// it is nil when the store is first used.
+	AlertHandler func(err error)
+
+	path string
+	keys *KeyRing
+
+	mutex     sync.Mutex
+	file      *os.File
+	size      int64 // bytes of complete entries in file
+	records   map[string]SessionRecord
+	entries   int
+	compactAt int // entries before the next automatic compaction
+}
+
+// NewLogSessionStore opens or creates the log at path and replays it. The
+// entries are not encrypted, see NewLogSessionStoreWithKeys.
+//
+// A truncated last entry, as left by a crash during an append, is cut off.
+// Broken entries before it are skipped, see replay.
+func NewLogSessionStore(path string) (*LogSessionStore, error) {
+	return NewLogSessionStoreWithKeys(path, nil)
+}
+
+// NewLogSessionStoreWithKeys opens or creates the log at path and replays
+// it, like NewLogSessionStore. If keys is not nil, every entry is
+// encrypted with it. Entries that are still plaintext, or sealed with an
+// older key of the ring, are sealed with the current key by compacting the
+// log right away.
+//
+//	keys, err := compass.NewKeyRing(secret)
+//	store, err := compass.NewLogSessionStoreWithKeys(".compass/sessions.log", keys)
+func NewLogSessionStoreWithKeys(path string, keys *KeyRing) (*LogSessionStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create session log directory: %w", err)
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open session log: %w", err)
+	}
+
+	l := &LogSessionStore{
+		path:    path,
+		keys:    keys,
+		file:    file,
+		records: make(map[string]SessionRecord),
+	}
+
+	if err = l.replay(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// replay reads the log from the start and applies every entry, one per
+// line.
+//
+// A broken last line is what a crash during an append leaves behind. The
+// change it described was never reported as saved, so it is cut off, the
+// way a write-ahead log drops a torn record. Broken lines before the end
+// can't come from a crash, since every append is synced before the next
+// one starts. They are skipped so the server still starts, and the log is
+// compacted without them. The original is kept as path.corrupt.
+//
+// Sealed entries that fail to open count as broken, unless none opens at
+// all. Then the keys are most likely wrong, and replay fails instead of
+// dropping every session.
+func (l *LogSessionStore) replay() error {
+	reader := bufio.NewReader(l.file)
+
+	var offset int64
+	broken, migrate := false, false
+	opened, failed := 0, 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read session log: %w", err)
+		}
+
+		if err == io.EOF {
+			if len(line) > 0 {
+				if err = l.file.Truncate(offset); err != nil {
+					return fmt.Errorf("failed to cut off broken session log entry: %w", err)
+				}
+			}
+			break
+		}
+
+		offset += int64(len(line))
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		raw, sealed, rotated, err := l.openEntry(bytes.TrimSpace(line))
+		if err != nil {
+			return fmt.Errorf("failed to read session log: %w", err)
+		}
+
+		if sealed {
+			if raw == nil {
+				failed++
+				broken = true
+				continue
+			}
+			opened++
+		}
+		migrate = migrate || rotated
+
+		var entry logEntry
+		if json.Unmarshal(raw, &entry) != nil || entry.Op == "" {
+			broken = true
+			continue
+		}
+
+		l.apply(entry)
+	}
+
+	l.size = offset
+	if failed > 0 && opened == 0 {
+		return fmt.Errorf("failed to read session log: %d entries are sealed with an unknown key", failed)
+	}
+
+	if !broken {
+		if migrate {
+			return l.compact()
+		}
+
+		return nil
+	}
+
+	data, err := os.ReadFile(l.path)
+	if err == nil {
+		err = writeFileAtomic(l.path+".corrupt", data)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to keep a copy of corrupt session log %s: %w", l.path, err)
+	}
+
+	return l.compact()
+}
+
+// openEntry returns the JSON of a log line. Sealed lines are base64 and
+// never start with "{". If one fails to open, raw is nil.
+//
+// rotated is true if the line should be sealed again with the first key,
+// because it is plaintext or sealed with an older one.
+func (l *LogSessionStore) openEntry(line []byte) (raw []byte, sealed bool, rotated bool, err error) {
+	if bytes.HasPrefix(line, []byte("{")) {
+		return line, false, l.keys != nil, nil
+	}
+
+	if l.keys == nil {
+		return nil, true, false, errors.New("log is encrypted, but the store has no keys")
+	}
+
+	data, err := base64.RawURLEncoding.AppendDecode(nil, line)
+	if err != nil {
+		return nil, true, false, nil
+	}
+
+	raw, rotated, err = l.keys.open(data, sealedLogContext)
+	if err != nil {
+		return nil, true, false, nil
+	}
+
+	return raw, true, rotated, nil
+}
+
+// encodeEntry returns the line of an entry, sealed if the store has keys.
+func (l *LogSessionStore) encodeEntry(entry logEntry) ([]byte, error) {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal session %s: %w", entry.ID, err)
+	}
+
+	if l.keys != nil {
+		sealed, err := l.keys.seal(raw, sealedLogContext)
+		if err != nil {
+			return nil, fmt.Errorf("failed to seal session %s: %w", entry.ID, err)
+		}
+		raw = base64.RawURLEncoding.AppendEncode(nil, sealed)
+	}
+
+	return append(raw, '\n'), nil
+}
+
+// saveEntry returns the entry that saves a record.
+func saveEntry(id string, record SessionRecord) logEntry {
+	return logEntry{
+		Op:          "save",
+		ID:          id,
+		Data:        record.Data,
+		LastAccess:  record.LastAccess,
+		Destroyed:   record.Destroyed,
+		CreatedAt:   record.CreatedAt,
+		IdleTimeout: record.IdleTimeout,
+		MaxLifetime: record.MaxLifetime,
+	}
+}
+
+// record returns the record a save entry describes.
+func (e logEntry) record() SessionRecord {
+	return SessionRecord{
+		Data:        e.Data,
+		LastAccess:  e.LastAccess,
+		Destroyed:   e.Destroyed,
+		CreatedAt:   e.CreatedAt,
+		IdleTimeout: e.IdleTimeout,
+		MaxLifetime: e.MaxLifetime,
+	}
+}
+
+// apply updates the in-memory state with an entry.
+func (l *LogSessionStore) apply(entry logEntry) {
+	l.entries++
+
+	switch entry.Op {
+	case "save":
+		l.records[entry.ID] = cloneRecord(entry.record())
+	case "touch":
+		if record, ok := l.records[entry.ID]; ok {
+			record.LastAccess = entry.LastAccess
+			l.records[entry.ID] = record
+		}
+	case "rename":
+		if record, ok := l.records[entry.ID]; ok {
+			l.records[entry.To] = record
+			delete(l.records, entry.ID)
+		}
+	case "delete":
+		delete(l.records, entry.ID)
+	}
+}
+
+// append writes an entry to the log, applies it and compacts the log if
+// it has grown too much. It must be called with the mutex held.
+func (l *LogSessionStore) append(entry logEntry) error {
+	if l.file == nil {
+		return errors.New("session log is closed")
+	}
+
+	line, err := l.encodeEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	// Sync every entry, so a crash can only ever tear the last one, which
+	// replay cuts off. If the write or sync fails, the log is cut back to
+	// where it was, so no later entry ends up behind a torn one.
+	_, err = l.file.Write(line)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		l.file.Truncate(l.size)
+		return fmt.Errorf("failed to append to session log: %w", err)
+	}
+
+	l.size += int64(len(line))
+	l.apply(entry)
+
+	if l.entries > logCompactMin && l.entries > 2*len(l.records) && l.entries >= l.compactAt {
+		if err = l.compact(); err != nil {
+			// Don't rewrite the whole log on every append while the
+			// problem lasts.
+			l.compactAt = l.entries + logCompactMin
+			if l.AlertHandler != nil {
+				l.AlertHandler(err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// compact rewrites the log with one entry per session into a temporary
+// file and moves it over the old one. It must be called with the mutex
+// held.
+//
+// The temporary file is opened for appending before the rename, so if
+// anything fails, the old file is still in place and still used.
+func (l *LogSessionStore) compact() error {
+	tmp, err := os.CreateTemp(filepath.Dir(l.path), ".sessions-*")
+	if err != nil {
+		return fmt.Errorf("failed to create compacted session log: %w", err)
+	}
+
+	writer := bufio.NewWriter(tmp)
+	for id, record := range l.records {
+		var line []byte
+		if line, err = l.encodeEntry(saveEntry(id, record)); err != nil {
+			break
+		}
+
+		if _, err = writer.Write(line); err != nil {
+			break
+		}
+	}
+
+	if err == nil {
+		err = writer.Flush()
+	}
+
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	var file *os.File
+	if err == nil {
+		file, err = os.OpenFile(tmp.Name(), os.O_RDWR|os.O_APPEND, 0600)
+	}
+
+	var info os.FileInfo
+	if err == nil {
+		info, err = file.Stat()
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), l.path)
+	}
+
+	if err != nil {
+		if file != nil {
+			file.Close()
+		}
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to compact session log: %w", err)
+	}
+
+	syncDir(filepath.Dir(l.path))
+
+	l.file.Close()
+	l.file = file
+	l.size = info.Size()
+	l.entries = len(l.records)
+	l.compactAt = 0
+	return nil
+}
+
+// alertTo sets AlertHandler, unless the user has set one already.
+func (l *LogSessionStore) alertTo(handler func(err error)) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.AlertHandler == nil {
+		l.AlertHandler = handler
+	}
+}
+
+// Compact rewrites the log with one entry per session. This happens
+// automatically, but can be useful before a backup.
+func (l *LogSessionStore) Compact() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return errors.New("session log is closed")
+	}
+
+	return l.compact()
+}
+
+// Close syncs and closes the log. The store can't be used afterwards.
+func (l *LogSessionStore) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+
+	err := l.file.Sync()
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+
+	l.file = nil
+	return err
+}
+
+// Load returns a copy of a session.
+func (l *LogSessionStore) Load(id string) (SessionRecord, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	record, ok := l.records[id]
+	if !ok {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+
+	return cloneRecord(record), nil
+}
+
+// Save appends the full session to the log.
+func (l *LogSessionStore) Save(id string, record SessionRecord) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return l.append(saveEntry(id, record))
+}
+
+// Delete appends a deletion to the log.
+func (l *LogSessionStore) Delete(id string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.records[id]; !ok {
+		return nil
+	}
+
+	return l.append(logEntry{Op: "delete", ID: id})
+}
+
+// Rename appends a rename to the log. As a single entry, it is atomic.
+func (l *LogSessionStore) Rename(oldID string, newID string) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.records[oldID]; !ok {
+		return ErrSessionNotFound
+	}
+
+	return l.append(logEntry{Op: "rename", ID: oldID, To: newID})
+}
+
+// List returns the ids of all sessions.
+func (l *LogSessionStore) List() ([]string, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	return recordIDs(l.records), nil
+}
+
+// Touch appends a last access update to the log, which is much smaller
+// than saving the session again.
+func (l *LogSessionStore) Touch(id string, lastAccess int64) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if _, ok := l.records[id]; !ok {
+		return ErrSessionNotFound
+	}
+
+	return l.append(logEntry{Op: "touch", ID: id, LastAccess: lastAccess})
+}
@@ -0,0 +1,141 @@
+package compass
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// reopenLogStore closes a LogSessionStore and opens its file again with
+// keys.
+func reopenLogStore(t *testing.T, store *LogSessionStore, keys *KeyRing) (*LogSessionStore, error) {
+	t.Helper()
+
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewLogSessionStoreWithKeys(store.path, keys)
+}
+
+func TestLogSessionStoreEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+
+	store, err := NewLogSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Save("plain", SessionRecord{LastAccess: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Plaintext entries are sealed when the log is opened with keys.
+	oldSecret := newTestSecret(t)
+	store, err = reopenLogStore(t, store, newTestKeyRing(t, oldSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Save("sealed", SessionRecord{LastAccess: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(raw, []byte("plain")) || bytes.Contains(raw, []byte("last_access")) {
+		t.Fatalf("log holds plaintext: %q", raw)
+	}
+
+	if _, err = NewLogSessionStore(path); err == nil {
+		t.Fatal("opened a sealed log without keys")
+	}
+
+	newSecret := newTestSecret(t)
+	if _, err = NewLogSessionStoreWithKeys(path, newTestKeyRing(t, newSecret)); err == nil {
+		t.Fatal("opened a sealed log with an unknown key")
+	}
+
+	// Entries sealed with an old key are sealed again with the new one.
+	store, err = NewLogSessionStoreWithKeys(path, newTestKeyRing(t, newSecret, oldSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = reopenLogStore(t, store, newTestKeyRing(t, newSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for id, lastAccess := range map[string]int64{"plain": 1, "sealed": 2} {
+		record, err := store.Load(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if record.LastAccess != lastAccess {
+			t.Fatalf("%s: LastAccess = %d, want %d", id, record.LastAccess, lastAccess)
+		}
+	}
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogSessionStoreSkipsTamperedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	keys := newTestKeyRing(t, newTestSecret(t))
+
+	store, err := NewLogSessionStoreWithKeys(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err = store.Save(id, SessionRecord{LastAccess: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := bytes.Split(raw, []byte("\n"))
+	lines[1][10] ^= 0x01
+	if err = os.WriteFile(path, bytes.Join(lines, []byte("\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewLogSessionStoreWithKeys(path, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	if _, err = store.Load("b"); err != ErrSessionNotFound {
+		t.Fatalf("Load of the tampered entry: err = %v, want %v", err, ErrSessionNotFound)
+	}
+
+	if _, err = store.Load("c"); err != nil {
+		t.Fatalf("Load after the tampered entry: %v", err)
+	}
+
+	if _, err = os.Stat(path + ".corrupt"); err != nil {
+		t.Fatalf("no copy of the corrupt log: %v", err)
+	}
+}
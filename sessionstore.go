@@ -0,0 +1,542 @@
+package compass
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ErrSessionNotFound is returned by SessionStore.Load if no session with
+// the given id is stored.
+var ErrSessionNotFound = errors.New("session not found")
+
+// ErrSessionCorrupt is wrapped by SessionStore.Load if a stored session
+// exists, but can't be parsed, or, if it is encrypted, fails to decrypt or
+// authenticate.
+var ErrSessionCorrupt = errors.New("session is corrupt")
+
+// Keys under which FileSessionStore keeps the record fields inside the
+// session's JSON object. They predate SessionStore and are kept so that
+// existing session files still load.
+const (
+	sessionLastAccessKey  = "--COMPASS-Last-Access"
+	sessionDestroyedKey   = "--COMPASS-Destroyed"
+	sessionCreatedKey     = "--COMPASS-Created"
+	sessionIdleTimeoutKey = "--COMPASS-Idle-Timeout"
+	sessionMaxLifetimeKey = "--COMPASS-Max-Lifetime"
+)
+
+// sealedFilePrefix starts the files of a FileSessionStore with Keys. JSON
+// can't start like this, so plaintext and sealed files can be told apart.
+const sealedFilePrefix = "compass-sealed-v1\n"
+
+// sealedFileContext is the KeyRing context of sealed session files.
+var sealedFileContext = []byte("compass session file")
+
+// SessionRecord is the stored form of a Session.
+type SessionRecord struct {
+	Data       map[string]json.RawMessage
+	LastAccess int64 // UnixMilli
+	Destroyed  bool
+
+	// CreatedAt is when the session was created, in UnixMilli. Zero for
+	// sessions stored before it existed.
+	CreatedAt int64
+
+	// IdleTimeout and MaxLifetime override the server's timeouts, in
+	// milliseconds. Zero uses the server's.
+	IdleTimeout int64
+	MaxLifetime int64
+}
+
+// SessionStore is the storage backend sessions are kept in.
+//
+// Load returns ErrSessionNotFound for unknown ids. Delete of an unknown id
+// is not an error. Touch only updates LastAccess, so stores can make it
+// cheaper than a full Save.
+//
+// Calls for the same id are serialised by the Session. Calls for different
+// ids may happen concurrently.
+type SessionStore interface {
+	Load(id string) (SessionRecord, error)
+	Save(id string, record SessionRecord) error
+	Delete(id string) error
+	List() ([]string, error)
+	Touch(id string, lastAccess int64) error
+}
+
+// SessionVersioner can be implemented by a SessionStore that other
+// processes write to as well, like FileSessionStore.
+//
+// Version returns a value that changes whenever the session is saved.
+// SessionGet compares it with the version of the last load and reloads the
+// session if it differs. It should be much cheaper than Load.
+type SessionVersioner interface {
+	Version(id string) (int64, error)
+}
+
+// SessionRenamer can be implemented by a SessionStore that can move a
+// session to a new id in one step, which Session.Regenerate then uses.
+//
+// Rename returns ErrSessionNotFound if oldID is not stored. Afterwards,
+// Load of oldID must fail.
+type SessionRenamer interface {
+	Rename(oldID string, newID string) error
+}
+
+// SessionQuarantiner can be implemented by a SessionStore to move a corrupt
+// session out of the way. It is no longer loaded, but kept for inspection.
+type SessionQuarantiner interface {
+	Quarantine(id string) error
+}
+
+// cloneRecord copies a record so the caller and the store don't share
+// the data map.
+func cloneRecord(record SessionRecord) SessionRecord {
+	record.Data = maps.Clone(record.Data)
+	if record.Data == nil {
+		record.Data = make(map[string]json.RawMessage)
+	}
+
+	return record
+}
+
+//
+// File store
+//
+
+// FileSessionStore is a SessionStore that keeps every session in its own
+// JSON file, named "<id>.json". This is the default store, in
+// CompassDir/session.
+//
+// Several processes can share the directory. It implements
+// SessionVersioner with the file's modification time, so changes made by
+// another process are picked up.
+//
+// Files are only readable by the owner. If Keys is set, their contents are
+// encrypted as well. Files that are still plaintext, or sealed with an
+// older key, are sealed with the current key when they are loaded.
+type FileSessionStore struct {
+	Dir  string
+	Keys *KeyRing
+}
+
+// NewFileSessionStore creates a FileSessionStore in dir. The directory is
+// created on the first Save.
+func NewFileSessionStore(dir string) *FileSessionStore {
+	return &FileSessionStore{Dir: dir}
+}
+
+// path returns the file of a session. An error is returned if the id would
+// escape the store's directory.
+func (f *FileSessionStore) path(id string) (string, error) {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return "", fmt.Errorf("invalid session id %q", id)
+	}
+
+	return filepath.Join(f.Dir, id+".json"), nil
+}
+
+// Load reads and parses the file of a session.
+func (f *FileSessionStore) Load(id string) (SessionRecord, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return SessionRecord{}, err
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+
+	if err != nil {
+		return SessionRecord{}, fmt.Errorf("failed to read session %s: %w", id, err)
+	}
+
+	raw, migrate, err := f.open(raw)
+	if errors.Is(err, errKeyRingOpen) {
+		return SessionRecord{}, fmt.Errorf("%w: %s: %w", ErrSessionCorrupt, id, err)
+	}
+
+	if err != nil {
+		return SessionRecord{}, fmt.Errorf("failed to open session %s: %w", id, err)
+	}
+
+	var data map[string]json.RawMessage
+	if err = json.Unmarshal(raw, &data); err != nil {
+		return SessionRecord{}, fmt.Errorf("%w: %s: %w", ErrSessionCorrupt, id, err)
+	}
+
+	if data == nil {
+		data = make(map[string]json.RawMessage)
+	}
+
+	// Files written by hand have no last access time. The modification
+	// time is the best guess.
+	record := SessionRecord{Data: data}
+	if info, err := os.Stat(path); err == nil {
+		record.LastAccess = info.ModTime().UnixMilli()
+	}
+
+	if value, ok := data[sessionLastAccessKey]; ok {
+		json.Unmarshal(value, &record.LastAccess)
+		delete(data, sessionLastAccessKey)
+	}
+
+	if value, ok := data[sessionDestroyedKey]; ok {
+		json.Unmarshal(value, &record.Destroyed)
+		delete(data, sessionDestroyedKey)
+	}
+
+	for key, field := range map[string]*int64{
+		sessionCreatedKey:     &record.CreatedAt,
+		sessionIdleTimeoutKey: &record.IdleTimeout,
+		sessionMaxLifetimeKey: &record.MaxLifetime,
+	} {
+		if value, ok := data[key]; ok {
+			json.Unmarshal(value, field)
+			delete(data, key)
+		}
+	}
+
+	// A failed migration is tried again on the next load. The session
+	// itself is fine either way.
+	if migrate {
+		f.Save(id, record)
+	}
+
+	return record, nil
+}
+
+// open returns the JSON of a session file. Sealed files are decrypted.
+// migrate is true if the file should be sealed again with the first key,
+// because it is plaintext or sealed with an older one.
+func (f *FileSessionStore) open(raw []byte) (plaintext []byte, migrate bool, err error) {
+	sealed, ok := bytes.CutPrefix(raw, []byte(sealedFilePrefix))
+	if !ok {
+		return raw, f.Keys != nil, nil
+	}
+
+	if f.Keys == nil {
+		return nil, false, errors.New("file is encrypted, but the store has no keys")
+	}
+
+	return f.Keys.open(sealed, sealedFileContext)
+}
+
+// Save writes a session to its file, replacing it.
+//
+// The data is written to a temporary file first, which is synced and then
+// renamed over the old file. A crash leaves either the old or the new
+// file, never a truncated one.
+func (f *FileSessionStore) Save(id string, record SessionRecord) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	data := maps.Clone(record.Data)
+	if data == nil {
+		data = make(map[string]json.RawMessage)
+	}
+
+	data[sessionLastAccessKey], _ = json.Marshal(record.LastAccess)
+	data[sessionDestroyedKey], _ = json.Marshal(record.Destroyed)
+
+	// Only written if set, so files of sessions without them look like
+	// they always did.
+	for key, value := range map[string]int64{
+		sessionCreatedKey:     record.CreatedAt,
+		sessionIdleTimeoutKey: record.IdleTimeout,
+		sessionMaxLifetimeKey: record.MaxLifetime,
+	} {
+		if value != 0 {
+			data[key], _ = json.Marshal(value)
+		}
+	}
+
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal session %s: %w", id, err)
+	}
+
+	if f.Keys != nil {
+		sealed, err := f.Keys.seal(raw, sealedFileContext)
+		if err != nil {
+			return fmt.Errorf("failed to seal session %s: %w", id, err)
+		}
+		raw = append([]byte(sealedFilePrefix), sealed...)
+	}
+
+	if err = os.MkdirAll(f.Dir, 0700); err != nil {
+		return fmt.Errorf("failed to create session directory: %w", err)
+	}
+
+	if err = writeFileAtomic(path, raw); err != nil {
+		return fmt.Errorf("failed to write session %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// Delete removes the file of a session.
+func (f *FileSessionStore) Delete(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to delete session %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// List returns the ids of all session files. A missing directory means
+// there are no sessions.
+//
+// Temporary files of Save, quarantined files and names that are not a
+// valid id are skipped.
+func (f *FileSessionStore) List() ([]string, error) {
+	entries, err := os.ReadDir(f.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	var ids []string
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".") || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+
+		id := strings.TrimSuffix(entry.Name(), ".json")
+		if _, err = f.path(id); err != nil {
+			continue
+		}
+
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// Touch updates the last access time stored in a session's file. The file
+// is rewritten, since the time is part of its JSON.
+func (f *FileSessionStore) Touch(id string, lastAccess int64) error {
+	record, err := f.Load(id)
+	if err != nil {
+		return err
+	}
+
+	record.LastAccess = lastAccess
+	return f.Save(id, record)
+}
+
+// Rename moves the file of a session with os.Rename, which is atomic
+// within a file system.
+func (f *FileSessionStore) Rename(oldID string, newID string) error {
+	oldPath, err := f.path(oldID)
+	if err != nil {
+		return err
+	}
+
+	newPath, err := f.path(newID)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(oldPath, newPath); err != nil {
+		if os.IsNotExist(err) {
+			return ErrSessionNotFound
+		}
+		return fmt.Errorf("failed to rename session %s: %w", oldID, err)
+	}
+
+	return nil
+}
+
+// Quarantine renames the file of a session to "<id>.json.corrupt", which
+// List skips. An older quarantined file of the same id is replaced.
+func (f *FileSessionStore) Quarantine(id string) error {
+	path, err := f.path(id)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Rename(path, path+".corrupt"); err != nil {
+		if os.IsNotExist(err) {
+			return ErrSessionNotFound
+		}
+		return fmt.Errorf("failed to quarantine session %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// Version returns the modification time of a session's file in UnixNano.
+func (f *FileSessionStore) Version(id string) (int64, error) {
+	path, err := f.path(id)
+	if err != nil {
+		return 0, err
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.ModTime().UnixNano(), nil
+}
+
+// writeFileAtomic replaces the file at path with data. It writes a hidden
+// temporary file in the same directory, syncs it and renames it over path.
+// The directory is synced afterwards, so the rename survives a crash as
+// well. The file is only readable by the owner.
+func writeFileAtomic(path string, data []byte) error {
+	dir, name := filepath.Split(path)
+
+	tmp, err := os.CreateTemp(dir, "."+name+".tmp-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	syncDir(dir)
+	return nil
+}
+
+// syncDir syncs a directory, so renames and new files in it are durable.
+// Not every platform supports this, so errors are ignored.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+
+	d.Sync()
+	d.Close()
+}
+
+//
+// Memory store
+//
+
+// MemorySessionStore is a SessionStore that keeps sessions in memory only.
+// They are lost when the process exits, which makes it useful for tests
+// and throwaway instances.
+type MemorySessionStore struct {
+	mutex   sync.Mutex
+	records map[string]SessionRecord
+}
+
+// NewMemorySessionStore creates an empty MemorySessionStore.
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{records: make(map[string]SessionRecord)}
+}
+
+// Load returns a copy of a stored session.
+func (m *MemorySessionStore) Load(id string) (SessionRecord, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record, ok := m.records[id]
+	if !ok {
+		return SessionRecord{}, ErrSessionNotFound
+	}
+
+	return cloneRecord(record), nil
+}
+
+// Save stores a copy of a session.
+func (m *MemorySessionStore) Save(id string, record SessionRecord) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.records[id] = cloneRecord(record)
+	return nil
+}
+
+// Delete removes a session.
+func (m *MemorySessionStore) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.records, id)
+	return nil
+}
+
+// List returns the ids of all stored sessions.
+func (m *MemorySessionStore) List() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return recordIDs(m.records), nil
+}
+
+// Touch updates the last access time of a stored session.
+func (m *MemorySessionStore) Touch(id string, lastAccess int64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record, ok := m.records[id]
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	record.LastAccess = lastAccess
+	m.records[id] = record
+	return nil
+}
+
+// Rename moves a stored session to a new id.
+func (m *MemorySessionStore) Rename(oldID string, newID string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	record, ok := m.records[oldID]
+	if !ok {
+		return ErrSessionNotFound
+	}
+
+	m.records[newID] = record
+	delete(m.records, oldID)
+	return nil
+}
+
+// recordIDs returns the ids of a record map in no particular order.
+func recordIDs(records map[string]SessionRecord) []string {
+	ids := make([]string, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
@@ -0,0 +1,130 @@
+package compass
+
+import "time"
+
+// SetIdleTimeout stages how long the session may go without being
+// accessed, overriding ServerConfiguration.SessionExpiryTime. Use a long
+// one for "remember me" and a short one for admin sessions. Zero reverts
+// to the server's.
+func (tx *SessionTransaction) SetIdleTimeout(d time.Duration) {
+	ms := max(d.Milliseconds(), 0)
+	tx.idleTimeout = &ms
+}
+
+// SetMaxLifetime stages how long the session may live after it was
+// created, no matter how active it is, overriding
+// ServerConfiguration.SessionMaxLifetime. Zero reverts to the server's,
+// a negative duration removes the limit for this session.
+func (tx *SessionTransaction) SetMaxLifetime(d time.Duration) {
+	ms := d.Milliseconds()
+	if d < 0 {
+		ms = -1
+	}
+	tx.maxLifetime = &ms
+}
+
+// CreatedAt returns the time the session was created, in UnixMilli. For
+// sessions stored by older versions, it is their last access at the time
+// they were loaded.
+func (s *Session) CreatedAt() int64 {
+	s.rwMutex.RLock()
+	defer s.rwMutex.RUnlock()
+
+	return s.createdAt
+}
+
+// IdleTimeout returns how long the session may go without being
+// accessed: its own idle timeout, or the server's SessionExpiryTime.
+func (s *Session) IdleTimeout() time.Duration {
+	idle, _ := s.timeouts()
+	return time.Duration(idle) * time.Millisecond
+}
+
+// MaxLifetime returns how long the session may live after it was created:
+// its own max lifetime, or the server's SessionMaxLifetime. Zero means no
+// limit.
+func (s *Session) MaxLifetime() time.Duration {
+	_, maxLifetime := s.timeouts()
+	return time.Duration(maxLifetime) * time.Millisecond
+}
+
+// ExpiresAt returns the time the session expires, in UnixMilli, unless it
+// is accessed before. That is its idle timeout after the last access, or
+// the end of its max lifetime if that comes first.
+func (s *Session) ExpiresAt() int64 {
+	idle, maxLifetime := s.timeouts()
+
+	expiresAt := s.LastAccess() + idle
+	if maxLifetime > 0 {
+		expiresAt = min(expiresAt, s.CreatedAt()+maxLifetime)
+	}
+
+	return expiresAt
+}
+
+// expired reports whether the session has expired at the given time, in
+// UnixMilli.
+func (s *Session) expired(now int64) bool {
+	_, ok := s.expiry(now)
+	return ok
+}
+
+// expiry reports whether the session has expired at the given time, in
+// UnixMilli, and which timeout ran out. If both did, it is the max
+// lifetime, since no activity could have prevented that.
+func (s *Session) expiry(now int64) (SessionReason, bool) {
+	idle, maxLifetime := s.timeouts()
+
+	if maxLifetime > 0 && now > s.CreatedAt()+maxLifetime {
+		return SessionReasonMaxLifetime, true
+	}
+
+	if now > s.LastAccess()+idle {
+		return SessionReasonIdle, true
+	}
+
+	return "", false
+}
+
+// timeouts returns the idle timeout and max lifetime of the session in
+// milliseconds, with the server's applied where the session has none. A
+// max lifetime of zero means no limit.
+func (s *Session) timeouts() (idle int64, maxLifetime int64) {
+	s.rwMutex.RLock()
+	idle, maxLifetime = s.idleTimeout, s.maxLifetime
+	s.rwMutex.RUnlock()
+
+	if idle <= 0 {
+		idle = int64(s.server.Config.SessionExpiryTime)
+	}
+
+	switch {
+	case maxLifetime < 0:
+		maxLifetime = 0
+	case maxLifetime == 0:
+		maxLifetime = int64(s.server.Config.SessionMaxLifetime)
+	}
+
+	return idle, maxLifetime
+}
+
+// cookieExpiry returns the Max-Age and Expires of the session cookie, so
+// the browser keeps it exactly as long as the server keeps the session.
+//
+// The idle part is extended by a tick, since the cookie is only refreshed
+// once per tick (see attachSessionCookies). Otherwise the browser could
+// drop it while the session is still alive. The server expires the
+// session on time either way. The end of the max lifetime is exact.
+func (s *Session) cookieExpiry(now int64) (maxAge int, expires time.Time) {
+	idle, maxLifetime := s.timeouts()
+
+	end := s.LastAccess() + idle + int64(s.server.Config.SessionTickInterval)
+	if maxLifetime > 0 {
+		end = min(end, s.CreatedAt()+maxLifetime)
+	}
+
+	// Max-Age 0 would delete the cookie right away, which is what
+	// RemoveCookie is for.
+	maxAge = int(max(end-now, 1000) / 1000)
+	return maxAge, time.UnixMilli(now + int64(maxAge)*1000).UTC()
+}
@@ -0,0 +1,339 @@
+package compass
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultHeartbeat is the interval in which SSE sends a comment line to keep
+// idle connections from being closed by proxies.
+const DefaultHeartbeat = 15 * time.Second
+
+// Event is a single Server-Sent Event.
+//
+// Only Data is required. Retry is in milliseconds and omitted if zero.
+type Event struct {
+	ID    string
+	Event string
+	Data  string
+	Retry int
+}
+
+// format serialises the event in the text/event-stream format.
+//
+// Newlines in ID and Event are removed, because they would end the field.
+// Multi-line data is split into multiple data fields.
+func (e Event) format() string {
+	var b strings.Builder
+	stripNewlines := strings.NewReplacer("\r", "", "\n", "")
+
+	if e.ID != "" {
+		fmt.Fprintf(&b, "id: %s\n", stripNewlines.Replace(e.ID))
+	}
+
+	if e.Event != "" {
+		fmt.Fprintf(&b, "event: %s\n", stripNewlines.Replace(e.Event))
+	}
+
+	if e.Retry > 0 {
+		fmt.Fprintf(&b, "retry: %d\n", e.Retry)
+	}
+
+	data := strings.ReplaceAll(e.Data, "\r\n", "\n")
+	for _, line := range strings.Split(data, "\n") {
+		fmt.Fprintf(&b, "data: %s\n", line)
+	}
+
+	b.WriteString("\n")
+	return b.String()
+}
+
+// EventStream is an open Server-Sent Events connection to one client.
+//
+// It is safe to call Send from multiple goroutines.
+type EventStream struct {
+	w       http.ResponseWriter
+	control *http.ResponseController
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mutex       sync.Mutex
+	lastEventID string
+}
+
+// SSE creates a Server-Sent Events response with the DefaultHeartbeat.
+//
+// fn is called once the headers are sent and the connection stays open
+// until fn returns. Use stream.Done to wait for the client to disconnect.
+//
+//	return compass.SSE(func(stream *compass.EventStream) {
+//		for {
+//			select {
+//			case <-stream.Done():
+//				return
+//			case msg := <-messages:
+//				stream.Send(compass.Event{Event: "message", Data: msg})
+//			}
+//		}
+//	})
+func SSE(fn func(stream *EventStream)) Response {
+	return SSEWithHeartbeat(DefaultHeartbeat, fn)
+}
+
+// SSEWithHeartbeat creates a Server-Sent Events response that sends a
+// comment line every heartbeat. A heartbeat of zero disables it.
+func SSEWithHeartbeat(heartbeat time.Duration, fn func(stream *EventStream)) Response {
+	typ := "text/event-stream"
+	resp := Raw(&typ, nil, http.StatusOK)
+	resp.Headers.Set("Cache-Control", "no-cache")
+	resp.Headers.Set("X-Accel-Buffering", "no")
+
+	resp.kind = KindStream
+	resp.stream = func(w http.ResponseWriter, r *http.Request) error {
+		ctx, cancel := context.WithCancel(r.Context())
+		stream := &EventStream{
+			w:           w,
+			control:     http.NewResponseController(w),
+			ctx:         ctx,
+			cancel:      cancel,
+			lastEventID: r.Header.Get("Last-Event-ID"),
+		}
+		defer stream.close()
+
+		if err := stream.flush(); err != nil {
+			return fmt.Errorf("failed to open event stream: %w", err)
+		}
+
+		if heartbeat > 0 {
+			go stream.doHeartbeat(heartbeat)
+		}
+
+		fn(stream)
+		return nil
+	}
+
+	return resp
+}
+
+// doHeartbeat writes a comment line every interval until the stream ends.
+// A failed write means the client is gone, so the stream is ended.
+func (e *EventStream) doHeartbeat(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-e.ctx.Done():
+			return
+		case <-ticker.C:
+			if err := e.write(": heartbeat\n\n"); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// close ends the stream. It waits for a running write to finish, so nothing
+// touches the ResponseWriter after the handler returned.
+func (e *EventStream) close() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	e.cancel()
+}
+
+// write writes raw text to the client and flushes it.
+func (e *EventStream) write(text string) error {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	if e.ctx.Err() != nil {
+		return e.ctx.Err()
+	}
+
+	if _, err := e.w.Write([]byte(text)); err != nil {
+		return err
+	}
+
+	return e.flush()
+}
+
+// flush pushes buffered data to the client.
+func (e *EventStream) flush() error {
+	return e.control.Flush()
+}
+
+// Send writes an event to the client.
+//
+// An error is returned if the client disconnected.
+func (e *EventStream) Send(event Event) error {
+	return e.write(event.format())
+}
+
+// SendData writes an event with only a data field to the client.
+func (e *EventStream) SendData(data string) error {
+	return e.Send(Event{Data: data})
+}
+
+// Done returns a channel that is closed when the client disconnects.
+func (e *EventStream) Done() <-chan struct{} {
+	return e.ctx.Done()
+}
+
+// LastEventID returns the Last-Event-ID the client sent when reconnecting,
+// or an empty string on the first connection.
+func (e *EventStream) LastEventID() string {
+	return e.lastEventID
+}
+
+//
+// Hub
+//
+
+// Hub broadcasts events to every subscribed EventStream.
+//
+// It keeps the last HistorySize events, so a client reconnecting with a
+// Last-Event-ID receives the events it missed. Clients that fall more than
+// BufferSize events behind are disconnected instead of slowing down the
+// broadcaster.
+//
+// The zero value is a hub without history and a buffer of one event. Use
+// NewHub for the defaults.
+type Hub struct {
+	HistorySize int
+	BufferSize  int
+
+	mutex   sync.Mutex
+	clients map[*hubClient]struct{}
+	history []Event
+	nextID  uint64
+}
+
+// hubClient is the queue of events waiting to be sent to one subscriber.
+type hubClient struct {
+	events chan Event
+}
+
+// NewHub creates a Hub with a history of 100 events and a buffer of 64
+// events per client.
+func NewHub() *Hub {
+	return &Hub{
+		HistorySize: 100,
+		BufferSize:  64,
+		clients:     make(map[*hubClient]struct{}),
+	}
+}
+
+// SSE returns a Server-Sent Events response that subscribes the client
+// to the hub until it disconnects.
+func (h *Hub) SSE() Response {
+	return SSE(h.Attach)
+}
+
+// Attach subscribes stream to the hub and blocks until the client
+// disconnects or is dropped for being too slow.
+//
+// If the client sent a Last-Event-ID that is still in the history, the
+// events after it are sent first.
+func (h *Hub) Attach(stream *EventStream) {
+	client := &hubClient{events: make(chan Event, max(h.BufferSize, 1))}
+
+	h.mutex.Lock()
+	missed := h.eventsAfter(stream.LastEventID())
+	if h.clients == nil {
+		h.clients = make(map[*hubClient]struct{})
+	}
+	h.clients[client] = struct{}{}
+	h.mutex.Unlock()
+
+	defer h.unsubscribe(client)
+
+	for _, event := range missed {
+		if err := stream.Send(event); err != nil {
+			return
+		}
+	}
+
+	for {
+		select {
+		case <-stream.Done():
+			return
+		case event, ok := <-client.events:
+			if !ok {
+				return
+			}
+
+			if err := stream.Send(event); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// eventsAfter returns the events in the history after the event with the
+// given id. The hub's mutex must be held.
+func (h *Hub) eventsAfter(id string) []Event {
+	if id == "" {
+		return nil
+	}
+
+	for i, event := range h.history {
+		if event.ID == id {
+			return append([]Event(nil), h.history[i+1:]...)
+		}
+	}
+
+	return nil
+}
+
+// unsubscribe removes a client from the hub.
+func (h *Hub) unsubscribe(client *hubClient) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	delete(h.clients, client)
+}
+
+// Broadcast sends an event to every subscribed client and stores it in the
+// history.
+//
+// If the event has no ID, a sequential one is assigned, so clients can
+// resume with Last-Event-ID.
+func (h *Hub) Broadcast(event Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if event.ID == "" {
+		h.nextID++
+		event.ID = strconv.FormatUint(h.nextID, 10)
+	}
+
+	if h.HistorySize > 0 {
+		h.history = append(h.history, event)
+		if len(h.history) > h.HistorySize {
+			h.history = h.history[len(h.history)-h.HistorySize:]
+		}
+	}
+
+	for client := range h.clients {
+		select {
+		case client.events <- event:
+		default:
+			close(client.events)
+			delete(h.clients, client)
+		}
+	}
+}
+
+// Count returns the number of currently subscribed clients.
+func (h *Hub) Count() int {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return len(h.clients)
+}
@@ -0,0 +1,316 @@
+package compass
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// templateJob is a template render deferred until the response is written,
+// when the Server and Request are known.
+type templateJob struct {
+	name string
+	data any
+}
+
+// TemplateEngine renders html/template templates from the template
+// directory, which defaults to <AssetDir>/templates.
+//
+// Files in the "layouts" and "partials" subdirectories are shared by every
+// page. All other files are pages, named by their path relative to the
+// template directory, e.g. "users/show.html". A page uses a layout by
+// calling it and defining the blocks it leaves open:
+//
+//	{{template "layouts/base.html" .}}
+//	{{define "content"}}<p>Hello {{.Name}}</p>{{end}}
+type TemplateEngine struct {
+	server *Server
+
+	// Dir overrides the template directory.
+	Dir string
+
+	// Funcs are additional template functions. They must be set before the
+	// first render.
+	Funcs template.FuncMap
+
+	mutex     sync.RWMutex
+	loaded    bool
+	signature string
+	pages     map[string]*template.Template
+}
+
+// newTemplateEngine creates the TemplateEngine of a server.
+func newTemplateEngine(server *Server) *TemplateEngine {
+	return &TemplateEngine{
+		server: server,
+		Funcs:  make(template.FuncMap),
+		pages:  make(map[string]*template.Template),
+	}
+}
+
+// dir returns the directory templates are loaded from.
+func (t *TemplateEngine) dir() string {
+	if t.Dir != "" {
+		return t.Dir
+	}
+
+	return filepath.Join(t.server.Config.AssetDir, "templates")
+}
+
+// isShared reports whether a template name belongs to a layout or partial.
+func isShared(name string) bool {
+	return strings.HasPrefix(name, "layouts/") || strings.HasPrefix(name, "partials/")
+}
+
+// scan lists all template files, keyed by name, and computes a signature
+// from their names, sizes and modification times. The signature changes
+// whenever a template is added, removed or edited.
+func (t *TemplateEngine) scan() (map[string]string, string, error) {
+	files := make(map[string]string)
+	var signature strings.Builder
+
+	root := t.dir()
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() || !(strings.HasSuffix(path, ".html") || strings.HasSuffix(path, ".tmpl")) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+
+		name := filepath.ToSlash(rel)
+		files[name] = path
+		fmt.Fprintf(&signature, "%s:%d:%d;", name, info.Size(), info.ModTime().UnixNano())
+		return nil
+	})
+
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to scan templates in %s: %w", root, err)
+	}
+
+	return files, signature.String(), nil
+}
+
+// load parses all templates. Shared templates are parsed into a base set,
+// which is cloned for every page, so pages can define the same blocks
+// without overwriting each other.
+func (t *TemplateEngine) load(files map[string]string, signature string) error {
+	base := template.New("").Funcs(t.funcs(nil))
+
+	for name, path := range files {
+		if !isShared(name) {
+			continue
+		}
+
+		if err := parseTemplateFile(base.New(name), path); err != nil {
+			return err
+		}
+	}
+
+	pages := make(map[string]*template.Template)
+	for name, path := range files {
+		if isShared(name) {
+			continue
+		}
+
+		page, err := base.Clone()
+		if err != nil {
+			return fmt.Errorf("failed to clone templates for %s: %w", name, err)
+		}
+
+		if err = parseTemplateFile(page.New(name), path); err != nil {
+			return err
+		}
+
+		pages[name] = page
+	}
+
+	t.pages = pages
+	t.signature = signature
+	t.loaded = true
+	return nil
+}
+
+// parseTemplateFile reads a file and parses it into tmpl.
+func parseTemplateFile(tmpl *template.Template, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read template %s: %w", path, err)
+	}
+
+	if _, err = tmpl.Parse(string(content)); err != nil {
+		return fmt.Errorf("failed to parse template %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// Reload parses all templates again.
+func (t *TemplateEngine) Reload() error {
+	files, signature, err := t.scan()
+	if err != nil {
+		return err
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.load(files, signature)
+}
+
+// ensureLoaded loads the templates on first use. In DevMode, the template
+// directory is scanned on every call and reloaded if anything changed.
+func (t *TemplateEngine) ensureLoaded() error {
+	t.mutex.RLock()
+	loaded := t.loaded
+	signature := t.signature
+	t.mutex.RUnlock()
+
+	if loaded && !t.server.Config.DevMode {
+		return nil
+	}
+
+	files, current, err := t.scan()
+	if err != nil {
+		return err
+	}
+
+	if loaded && current == signature {
+		return nil
+	}
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.loaded && t.signature == current {
+		return nil
+	}
+
+	if t.loaded {
+		t.server.Logger.Info("Templates changed, reloading")
+	}
+
+	return t.load(files, current)
+}
+
+// render executes the page with the given name. The template set is cloned
+// first, so the request-bound helpers of concurrent renders do not mix.
+func (t *TemplateEngine) render(r *Request, name string, data any) ([]byte, error) {
+	if err := t.ensureLoaded(); err != nil {
+		return nil, err
+	}
+
+	t.mutex.RLock()
+	page, ok := t.pages[name]
+	t.mutex.RUnlock()
+
+	if !ok {
+		return nil, fmt.Errorf("template %q does not exist", name)
+	}
+
+	tmpl, err := page.Clone()
+	if err != nil {
+		return nil, fmt.Errorf("failed to clone template %q: %w", name, err)
+	}
+	tmpl.Funcs(t.funcs(r))
+
+	var buf bytes.Buffer
+	if err = tmpl.ExecuteTemplate(&buf, name, data); err != nil {
+		return nil, fmt.Errorf("failed to render template %q: %w", name, err)
+	}
+
+	return buf.Bytes(), nil
+}
+
+// funcs returns the helper functions available in templates, followed by
+// the user's Funcs. Request-bound helpers fail if r is nil, which is only
+// the case while parsing.
+func (t *TemplateEngine) funcs(r *Request) template.FuncMap {
+	// Flashes are consumed on first use and kept for the rest of the
+	// render, so a page can range over them more than once.
+	var flashes []Flash
+	flashesRead := false
+
+	funcs := template.FuncMap{
+		"urlFor": func(name string, params ...string) (string, error) {
+			return t.server.URLFor(name, params...)
+		},
+		"static": func(path string) string {
+			return strings.TrimSuffix(t.server.Config.StaticUrl, "/") + "/" + strings.TrimPrefix(path, "/")
+		},
+		"csrfToken": func() (string, error) {
+			if r == nil {
+				return "", fmt.Errorf("csrfToken is only available while rendering a request")
+			}
+			return r.CSRFToken(), nil
+		},
+		"csrfField": func() (template.HTML, error) {
+			if r == nil {
+				return "", fmt.Errorf("csrfField is only available while rendering a request")
+			}
+			return template.HTML(`<input type="hidden" name="` + CSRFFieldName + `" value="` + template.HTMLEscapeString(r.CSRFToken()) + `">`), nil
+		},
+		"flashes": func() ([]Flash, error) {
+			if r == nil {
+				return nil, fmt.Errorf("flashes is only available while rendering a request")
+			}
+
+			if !flashesRead {
+				var err error
+				if flashes, err = r.requestFlashes(); err != nil {
+					return nil, err
+				}
+				flashesRead = true
+			}
+
+			return flashes, nil
+		},
+	}
+
+	for name, fn := range t.Funcs {
+		funcs[name] = fn
+	}
+
+	return funcs
+}
+
+// Render creates a response that renders the named template with status
+// code 200.
+//
+// The template is rendered when the response is written, using the
+// server's TemplateEngine. If rendering fails, the request is answered
+// like an InternalError.
+//
+//	return compass.Render("users/show.html", user)
+func Render(name string, data any) Response {
+	return RenderWithCode(name, data, 200)
+}
+
+// RenderWithCode creates a response that renders the named template with
+// a custom status code.
+//
+// The template is rendered when the response is written, using the
+// server's TemplateEngine. If rendering fails, the request is answered
+// like an InternalError.
+func RenderWithCode(name string, data any, code int) Response {
+	typ := "text/html; charset=utf-8"
+	resp := Raw(&typ, nil, code)
+	resp.template = &templateJob{name: name, data: data}
+	return resp
+}
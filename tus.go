@@ -0,0 +1,540 @@
+package compass
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TusVersion is the version of the tus resumable upload protocol
+// implemented by TusHandler.
+const TusVersion = "1.0.0"
+
+// TusOptions configures a TusHandler.
+type TusOptions struct {
+	// Dir is where partial and finished uploads are stored.
+	// Defaults to <CompassDir>/tus if empty.
+	Dir string
+
+	// MaxSize is the maximum Upload-Length accepted. Zero means no limit.
+	MaxSize int64
+
+	// Expiry is how long (ms) an unfinished upload may go untouched before
+	// it is removed. Defaults to 24 hours if zero.
+	Expiry int64
+
+	// CompleteExpiry is how long (ms) a finished upload is kept after its
+	// last byte arrived. Zero keeps finished uploads until Remove is called,
+	// so cleaning them up is up to the caller.
+	CompleteExpiry int64
+
+	// OnComplete is called once the last byte of an upload was written. If
+	// it returns an error, the final PATCH is answered with an internal error.
+	OnComplete func(upload TusUpload) error
+}
+
+// TusUpload describes the state of a resumable upload.
+type TusUpload struct {
+	ID       string            `json:"id"`
+	Length   int64             `json:"length"`
+	Offset   int64             `json:"offset"`
+	Metadata map[string]string `json:"metadata"`
+
+	CreatedAt  int64 `json:"created_at"`
+	LastAccess int64 `json:"last_access"`
+}
+
+// Complete reports whether every byte of the upload was received.
+func (u TusUpload) Complete() bool {
+	return u.Offset >= u.Length
+}
+
+// TusHandler implements the core, creation, expiration and termination
+// parts of the tus protocol (https://tus.io/protocols/resumable-upload).
+//
+// Register it with Server.AddTusUpload.
+type TusHandler struct {
+	server *Server
+	path   string
+	opts   TusOptions
+
+	locksMutex sync.Mutex
+	locks      map[string]*uploadLock // upload id -> lock
+}
+
+// uploadLock serialises the requests for a single upload. refs counts the
+// goroutines holding or waiting for it, so the entry is only dropped once
+// nobody uses it anymore. Dropping it earlier would hand the next caller a
+// fresh mutex while the old one is still held.
+type uploadLock struct {
+	mutex sync.Mutex
+	refs  int
+}
+
+// AddTusUpload mounts a tus upload endpoint at path.
+//
+// Clients create uploads with a POST to path and continue them with
+// PATCH requests to path/<id>. Unfinished uploads are removed by the same
+// ticker that expires sessions once they exceed TusOptions.Expiry, finished
+// ones once they exceed TusOptions.CompleteExpiry.
+//
+//	server.AddTusUpload("/files", compass.TusOptions{
+//		MaxSize: 4 << 30,
+//		OnComplete: func(upload compass.TusUpload) error { ... },
+//	})
+func (s *Server) AddTusUpload(path string, opts TusOptions) *TusHandler {
+	if opts.Dir == "" {
+		opts.Dir = filepath.Join(s.Config.CompassDir, "tus")
+	}
+
+	if opts.Expiry == 0 {
+		opts.Expiry = 24 * 60 * 60 * 1000 // 24 hours
+	}
+
+	handler := &TusHandler{
+		server: s,
+		path:   "/" + strings.Trim(path, "/"),
+		opts:   opts,
+	}
+
+	collection := s.AddRoute(handler.path, handler.handleCollection)
+	collection.AllowedMethods = []string{"options", "post"}
+
+	item := s.AddRoute(handler.path+"/<id>", handler.handleUpload)
+	item.AllowedMethods = []string{"options", "head", "patch", "delete"}
+	item.MaxBodySize = -1 // bounded by Upload-Length instead
+
+	s.onTick(handler.expireUploads)
+	return handler
+}
+
+// FilePath returns the path of the data file of an upload. Once an upload
+// is complete, this is where its contents can be read or moved from.
+func (t *TusHandler) FilePath(id string) string {
+	return filepath.Join(t.opts.Dir, id+".bin")
+}
+
+// infoPath returns the path of the JSON file holding an upload's TusUpload.
+func (t *TusHandler) infoPath(id string) string {
+	return filepath.Join(t.opts.Dir, id+".json")
+}
+
+// Get returns the current state of an upload.
+func (t *TusHandler) Get(id string) (TusUpload, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return TusUpload{}, fmt.Errorf("invalid upload id %q", id)
+	}
+
+	raw, err := os.ReadFile(t.infoPath(id))
+	if err != nil {
+		return TusUpload{}, err
+	}
+
+	var upload TusUpload
+	if err = json.Unmarshal(raw, &upload); err != nil {
+		return TusUpload{}, fmt.Errorf("failed to unmarshal tus upload %s: %w", id, err)
+	}
+
+	return upload, nil
+}
+
+// Remove deletes an upload and its data file.
+func (t *TusHandler) Remove(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return fmt.Errorf("invalid upload id %q", id)
+	}
+
+	unlock := t.lock(id)
+	defer unlock()
+
+	return t.remove(id)
+}
+
+// remove deletes an upload's files. The upload's lock must be held.
+func (t *TusHandler) remove(id string) error {
+	err := os.Remove(t.FilePath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove tus upload %s: %w", id, err)
+	}
+
+	err = os.Remove(t.infoPath(id))
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove tus upload %s: %w", id, err)
+	}
+
+	return nil
+}
+
+// save writes the upload's info file via a temporary file, so a crash never
+// leaves a half-written info file behind.
+func (t *TusHandler) save(upload TusUpload) error {
+	data, err := json.Marshal(upload)
+	if err != nil {
+		return fmt.Errorf("failed to marshal tus upload %s: %w", upload.ID, err)
+	}
+
+	tmp := t.infoPath(upload.ID) + ".tmp"
+	if err = os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write tus upload %s: %w", upload.ID, err)
+	}
+
+	if err = os.Rename(tmp, t.infoPath(upload.ID)); err != nil {
+		return fmt.Errorf("failed to write tus upload %s: %w", upload.ID, err)
+	}
+
+	return nil
+}
+
+// lock acquires the lock of a single upload and returns the function that
+// releases it.
+func (t *TusHandler) lock(id string) (unlock func()) {
+	t.locksMutex.Lock()
+	if t.locks == nil {
+		t.locks = make(map[string]*uploadLock)
+	}
+
+	lock, ok := t.locks[id]
+	if !ok {
+		lock = &uploadLock{}
+		t.locks[id] = lock
+	}
+	lock.refs++
+	t.locksMutex.Unlock()
+
+	lock.mutex.Lock()
+	return func() {
+		lock.mutex.Unlock()
+
+		t.locksMutex.Lock()
+		lock.refs--
+		if lock.refs == 0 {
+			delete(t.locks, id)
+		}
+		t.locksMutex.Unlock()
+	}
+}
+
+// expired reports whether an unfinished upload exceeded Expiry, or a
+// finished one CompleteExpiry.
+func (t *TusHandler) expired(upload TusUpload) bool {
+	age := time.Now().UnixMilli() - upload.LastAccess
+	if upload.Complete() {
+		return t.opts.CompleteExpiry > 0 && age > t.opts.CompleteExpiry
+	}
+
+	return age > t.opts.Expiry
+}
+
+// expiresHeader formats the Upload-Expires header for an upload.
+func (t *TusHandler) expiresHeader(upload TusUpload) string {
+	return time.UnixMilli(upload.LastAccess + t.opts.Expiry).UTC().Format(http.TimeFormat)
+}
+
+// expireUploads removes every upload that expired, see expired. It is
+// registered with onTick by AddTusUpload.
+func (t *TusHandler) expireUploads() {
+	entries, err := os.ReadDir(t.opts.Dir)
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+
+		if err = t.expireIfStale(id); err != nil {
+			t.server.Logger.Error(err.Error())
+			t.server.AlertHandler(err)
+		}
+	}
+}
+
+// expireIfStale removes an upload if it has expired. The upload is read
+// and checked under its lock, so a PATCH that resumed it in the meantime
+// keeps it alive, and one that is running finishes before it is removed.
+func (t *TusHandler) expireIfStale(id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil
+	}
+
+	unlock := t.lock(id)
+	defer unlock()
+
+	upload, err := t.Get(id)
+	if err != nil || !t.expired(upload) {
+		return nil
+	}
+
+	return t.remove(id)
+}
+
+// tusResponse creates an empty response carrying the Tus-Resumable header.
+func tusResponse(code int) Response {
+	resp := TextWithCode("", code)
+	resp.Headers.Set("Tus-Resumable", TusVersion)
+	return resp
+}
+
+// handleOptions answers the discovery request of a client.
+func (t *TusHandler) handleOptions() Response {
+	resp := tusResponse(http.StatusNoContent)
+	resp.Headers.Set("Tus-Version", TusVersion)
+	resp.Headers.Set("Tus-Extension", "creation,expiration,termination")
+	if t.opts.MaxSize > 0 {
+		resp.Headers.Set("Tus-Max-Size", strconv.FormatInt(t.opts.MaxSize, 10))
+	}
+
+	return resp
+}
+
+// checkVersion answers with 412 if the client does not speak TusVersion.
+func (t *TusHandler) checkVersion(request Request) *Response {
+	if request.Http.Header.Get("Tus-Resumable") == TusVersion {
+		return nil
+	}
+
+	resp := tusResponse(http.StatusPreconditionFailed)
+	resp.Headers.Set("Tus-Version", TusVersion)
+	return &resp
+}
+
+// handleCollection handles requests to the endpoint itself, which is where
+// uploads are created.
+func (t *TusHandler) handleCollection(request Request) Response {
+	if request.Method == "options" {
+		return t.handleOptions()
+	}
+
+	if resp := t.checkVersion(request); resp != nil {
+		return *resp
+	}
+
+	length, err := strconv.ParseInt(request.Http.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return tusResponse(http.StatusBadRequest)
+	}
+
+	if t.opts.MaxSize > 0 && length > t.opts.MaxSize {
+		return tusResponse(http.StatusRequestEntityTooLarge)
+	}
+
+	metadata, ok := parseTusMetadata(request.Http.Header.Get("Upload-Metadata"))
+	if !ok {
+		return tusResponse(http.StatusBadRequest)
+	}
+
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return InternalError(fmt.Sprintf("failed to generate tus upload id: %s", err))
+	}
+
+	if err = os.MkdirAll(t.opts.Dir, 0755); err != nil {
+		return InternalError(fmt.Sprintf("failed to create tus directory: %s", err))
+	}
+
+	now := time.Now().UnixMilli()
+	upload := TusUpload{
+		ID:         id.String(),
+		Length:     length,
+		Metadata:   metadata,
+		CreatedAt:  now,
+		LastAccess: now,
+	}
+
+	if err = os.WriteFile(t.FilePath(upload.ID), nil, 0644); err != nil {
+		return InternalError(fmt.Sprintf("failed to create tus upload file: %s", err))
+	}
+
+	if err = t.save(upload); err != nil {
+		// Without an info file, expireUploads would never find it.
+		os.Remove(t.FilePath(upload.ID))
+		return InternalError(err.Error())
+	}
+
+	if upload.Complete() {
+		if resp := t.complete(upload); resp != nil {
+			return *resp
+		}
+	}
+
+	resp := tusResponse(http.StatusCreated)
+	resp.Headers.Set("Location", request.absoluteURL(t.path+"/"+upload.ID))
+	resp.Headers.Set("Upload-Expires", t.expiresHeader(upload))
+	return resp
+}
+
+// handleUpload handles requests to a single upload.
+func (t *TusHandler) handleUpload(request Request) Response {
+	if request.Method == "options" {
+		return t.handleOptions()
+	}
+
+	if resp := t.checkVersion(request); resp != nil {
+		return *resp
+	}
+
+	id, _ := request.GetRouteParam("id")
+	if _, err := uuid.Parse(id); err != nil {
+		return tusResponse(http.StatusNotFound)
+	}
+
+	unlock := t.lock(id)
+	defer unlock()
+
+	upload, err := t.Get(id)
+	if err != nil {
+		return tusResponse(http.StatusNotFound)
+	}
+
+	if t.expired(upload) {
+		t.remove(id)
+		return tusResponse(http.StatusGone)
+	}
+
+	switch request.Method {
+	case "head":
+		resp := tusResponse(http.StatusOK)
+		resp.Headers.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		resp.Headers.Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		resp.Headers.Set("Cache-Control", "no-store")
+		if len(upload.Metadata) > 0 {
+			resp.Headers.Set("Upload-Metadata", formatTusMetadata(upload.Metadata))
+		}
+		return resp
+	case "delete":
+		if err = t.remove(id); err != nil {
+			return InternalError(err.Error())
+		}
+		return tusResponse(http.StatusNoContent)
+	}
+
+	return t.handlePatch(request, upload)
+}
+
+// handlePatch appends the request body to an upload. The upload's lock
+// must be held.
+//
+// If the body can't be read to the end or the data can't be stored, the
+// data file is truncated back to the stored offset. The client resumes
+// from there, and the data file never holds bytes the offset doesn't
+// cover.
+func (t *TusHandler) handlePatch(request Request, upload TusUpload) Response {
+	if request.Http.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		return tusResponse(http.StatusUnsupportedMediaType)
+	}
+
+	offset, err := strconv.ParseInt(request.Http.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		return tusResponse(http.StatusBadRequest)
+	}
+
+	if offset != upload.Offset {
+		return tusResponse(http.StatusConflict)
+	}
+
+	file, err := os.OpenFile(t.FilePath(upload.ID), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return InternalError(fmt.Sprintf("failed to open tus upload %s: %s", upload.ID, err))
+	}
+
+	rollback := func(resp Response) Response {
+		err := file.Truncate(offset)
+		file.Close()
+		if err != nil {
+			return InternalError(fmt.Sprintf("failed to truncate tus upload %s: %s", upload.ID, err))
+		}
+
+		return resp
+	}
+
+	n, err := io.Copy(file, io.LimitReader(request.Http.Body, upload.Length-upload.Offset))
+	if err != nil {
+		return rollback(tusResponse(http.StatusBadRequest))
+	}
+
+	if err = file.Sync(); err != nil {
+		return rollback(InternalError(fmt.Sprintf("failed to sync tus upload %s: %s", upload.ID, err)))
+	}
+
+	upload.Offset += n
+	upload.LastAccess = time.Now().UnixMilli()
+	if err = t.save(upload); err != nil {
+		return rollback(InternalError(err.Error()))
+	}
+
+	file.Close()
+
+	if upload.Complete() {
+		if resp := t.complete(upload); resp != nil {
+			return *resp
+		}
+	}
+
+	resp := tusResponse(http.StatusNoContent)
+	resp.Headers.Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	if !upload.Complete() {
+		resp.Headers.Set("Upload-Expires", t.expiresHeader(upload))
+	}
+
+	return resp
+}
+
+// complete calls OnComplete and returns an error response if it fails.
+func (t *TusHandler) complete(upload TusUpload) *Response {
+	if t.opts.OnComplete == nil {
+		return nil
+	}
+
+	if err := t.opts.OnComplete(upload); err != nil {
+		resp := InternalError(fmt.Sprintf("tus completion callback failed for %s: %s", upload.ID, err))
+		return &resp
+	}
+
+	return nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header. Pairs are separated
+// by commas, and each pair is a key and an optional base64 encoded value.
+func parseTusMetadata(header string) (map[string]string, bool) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, true
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, false
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, false
+		}
+
+		metadata[key] = string(value)
+	}
+
+	return metadata, true
+}
+
+// formatTusMetadata encodes metadata for the Upload-Metadata header.
+func formatTusMetadata(metadata map[string]string) string {
+	pairs := make([]string, 0, len(metadata))
+	for key, value := range metadata {
+		pairs = append(pairs, key+" "+base64.StdEncoding.EncodeToString([]byte(value)))
+	}
+
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,357 @@
+package compass
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	// ErrNotMultipart is returned by Request.Uploads if the request body is
+	// not multipart/form-data.
+	ErrNotMultipart = errors.New("request is not multipart/form-data")
+
+	// ErrUploadTooLarge is returned by Request.Uploads if a file exceeds
+	// UploadOptions.MaxFileSize or all files exceed UploadOptions.MaxTotalSize.
+	ErrUploadTooLarge = errors.New("upload exceeds the allowed size")
+
+	// ErrUploadTypeNotAllowed is returned by Request.Uploads if the sniffed
+	// content type of a file is not in UploadOptions.AllowedTypes.
+	ErrUploadTypeNotAllowed = errors.New("upload content type is not allowed")
+
+	// ErrTooManyUploads is returned by Request.Uploads if the request contains
+	// more than UploadOptions.MaxFiles files.
+	ErrTooManyUploads = errors.New("too many files in upload")
+)
+
+// sniffLength is the amount of bytes http.DetectContentType looks at.
+const sniffLength = 512
+
+// UploadStore is the storage backend Request.Uploads streams files into.
+//
+// Save must consume r until EOF or an error. If r returns an error, Save
+// must remove anything it already wrote and return that error.
+type UploadStore interface {
+	Save(name string, contentType string, r io.Reader) (key string, err error)
+	Open(key string) (io.ReadCloser, error)
+	Delete(key string) error
+}
+
+// UploadOptions controls the limits enforced by Request.Uploads.
+//
+// Size limits of zero disable the respective check. The request body is
+// still capped by the route's MaxBodySize.
+type UploadOptions struct {
+	MaxFileSize  int64
+	MaxTotalSize int64
+	MaxFiles     int
+
+	// MaxValueSize caps the combined size of all non-file form fields.
+	// Defaults to 1MB if zero.
+	MaxValueSize int64
+
+	// AllowedTypes lists the accepted content types, for example
+	// "image/png" or "image/*". The type is sniffed from the file contents,
+	// the type sent by the client is ignored. Empty allows every type.
+	AllowedTypes []string
+
+	// Store receives the uploaded files. Defaults to a DiskUploadStore in
+	// <CompassDir>/uploads if nil.
+	Store UploadStore
+}
+
+// Upload describes a single file stored by Request.Uploads.
+type Upload struct {
+	Field       string
+	Filename    string
+	ContentType string
+	Size        int64
+	Key         string
+}
+
+// UploadResult holds the files and plain form values of a multipart request.
+type UploadResult struct {
+	Files  []Upload
+	Values map[string][]string
+}
+
+// Uploads streams the parts of a multipart/form-data request into an
+// UploadStore, without buffering whole files in memory or on disk.
+//
+// Filenames are sanitised, content types are sniffed from the first bytes
+// of each file and checked against AllowedTypes, and per-file and total
+// size limits are enforced while streaming. If any check fails, all files
+// stored by this call are deleted again and the error is returned.
+//
+//	result, err := request.Uploads(compass.UploadOptions{
+//		MaxFileSize:  10 << 20,
+//		AllowedTypes: []string{"image/*"},
+//	})
+func (r *Request) Uploads(opts UploadOptions) (*UploadResult, error) {
+	store := opts.Store
+	if store == nil {
+		if r.server == nil {
+			return nil, errors.New("no upload store given and request is not bound to a server")
+		}
+		store = NewDiskUploadStore(filepath.Join(r.server.Config.CompassDir, "uploads"))
+	}
+
+	maxValueSize := opts.MaxValueSize
+	if maxValueSize == 0 {
+		maxValueSize = 1 << 20
+	}
+
+	reader, err := r.Http.MultipartReader()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNotMultipart, err)
+	}
+
+	result := &UploadResult{
+		Files:  make([]Upload, 0),
+		Values: make(map[string][]string),
+	}
+
+	fail := func(err error) (*UploadResult, error) {
+		for _, file := range result.Files {
+			store.Delete(file.Key)
+		}
+		return nil, err
+	}
+
+	var total, valueSize int64
+	for {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(fmt.Errorf("failed to read multipart body: %w", err))
+		}
+
+		if part.FileName() == "" {
+			value, err := io.ReadAll(io.LimitReader(part, maxValueSize-valueSize+1))
+			part.Close()
+			if err != nil {
+				return fail(fmt.Errorf("failed to read form value %q: %w", part.FormName(), err))
+			}
+
+			valueSize += int64(len(value))
+			if valueSize > maxValueSize {
+				return fail(fmt.Errorf("%w: form values exceed %d bytes", ErrUploadTooLarge, maxValueSize))
+			}
+
+			result.Values[part.FormName()] = append(result.Values[part.FormName()], string(value))
+			continue
+		}
+
+		if opts.MaxFiles > 0 && len(result.Files) >= opts.MaxFiles {
+			part.Close()
+			return fail(fmt.Errorf("%w: more than %d files", ErrTooManyUploads, opts.MaxFiles))
+		}
+
+		head := make([]byte, sniffLength)
+		n, err := io.ReadFull(part, head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			part.Close()
+			return fail(fmt.Errorf("failed to read upload %q: %w", part.FileName(), err))
+		}
+		head = head[:n]
+
+		contentType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+		if !mediaTypeAllowed(contentType, opts.AllowedTypes) {
+			part.Close()
+			return fail(fmt.Errorf("%w: %s", ErrUploadTypeNotAllowed, contentType))
+		}
+
+		limit := int64(-1)
+		if opts.MaxFileSize > 0 {
+			limit = opts.MaxFileSize
+		}
+		if remaining := opts.MaxTotalSize - total; opts.MaxTotalSize > 0 && (limit < 0 || remaining < limit) {
+			limit = remaining
+		}
+
+		counter := &uploadLimitReader{r: io.MultiReader(bytes.NewReader(head), part), limit: limit}
+		filename := SanitizeFilename(part.FileName())
+
+		key, err := store.Save(filename, contentType, counter)
+		part.Close()
+		if err != nil {
+			return fail(fmt.Errorf("failed to store upload %q: %w", filename, err))
+		}
+
+		total += counter.n
+		result.Files = append(result.Files, Upload{
+			Field:       part.FormName(),
+			Filename:    filename,
+			ContentType: contentType,
+			Size:        counter.n,
+			Key:         key,
+		})
+	}
+
+	return result, nil
+}
+
+// mediaTypeAllowed checks a content type without parameters against a list
+// of allowed types. Entries ending in "/*" match a whole top-level type. An
+// empty list allows everything.
+func mediaTypeAllowed(contentType string, allowed []string) bool {
+	if len(allowed) == 0 {
+		return true
+	}
+
+	for _, entry := range allowed {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == contentType {
+			return true
+		}
+
+		if prefix, ok := strings.CutSuffix(entry, "/*"); ok && strings.HasPrefix(contentType, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// uploadLimitReader counts the bytes read through it and fails with
+// ErrUploadTooLarge once more than limit bytes were read. A negative limit
+// disables the check.
+type uploadLimitReader struct {
+	r     io.Reader
+	limit int64
+	n     int64
+}
+
+func (l *uploadLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	l.n += int64(n)
+
+	if l.limit >= 0 && l.n > l.limit {
+		return n, ErrUploadTooLarge
+	}
+
+	return n, err
+}
+
+// SanitizeFilename strips directories, control characters and characters
+// that are unsafe in filenames from a client supplied name.
+//
+// If nothing usable remains, "upload" is returned.
+func SanitizeFilename(name string) string {
+	name = strings.ReplaceAll(name, "\\", "/")
+	name = filepath.Base(name)
+
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return -1
+		}
+		return r
+	}, name)
+
+	name = strings.Trim(strings.TrimSpace(name), ".")
+	if name == "" {
+		return "upload"
+	}
+
+	return name
+}
+
+// DiskUploadStore is an UploadStore that writes files into a directory.
+//
+// Keys have the form "<uuid>_<filename>", so they are unique while still
+// showing the original name when looking at the directory.
+type DiskUploadStore struct {
+	Dir string
+}
+
+// NewDiskUploadStore creates a DiskUploadStore writing into dir. The
+// directory is created on the first Save.
+func NewDiskUploadStore(dir string) *DiskUploadStore {
+	return &DiskUploadStore{Dir: dir}
+}
+
+// Path returns the path of the file stored under key.
+//
+// An error is returned if the key would escape the store's directory.
+func (d *DiskUploadStore) Path(key string) (string, error) {
+	if key == "" || filepath.Base(key) != key || key == "." || key == ".." {
+		return "", fmt.Errorf("invalid upload key %q", key)
+	}
+
+	return filepath.Join(d.Dir, key), nil
+}
+
+// Save streams r into a temporary file and renames it once complete, so
+// partially written uploads never show up under their final key.
+func (d *DiskUploadStore) Save(name string, contentType string, r io.Reader) (string, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return "", fmt.Errorf("failed to generate upload key: %w", err)
+	}
+
+	if err = os.MkdirAll(d.Dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	key := id.String() + "_" + SanitizeFilename(name)
+	path, err := d.Path(key)
+	if err != nil {
+		return "", err
+	}
+
+	file, err := os.CreateTemp(d.Dir, ".upload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create upload file: %w", err)
+	}
+
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	if err = os.Rename(file.Name(), path); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to move upload into place: %w", err)
+	}
+
+	return key, nil
+}
+
+// Open opens the file stored under key for reading.
+func (d *DiskUploadStore) Open(key string) (io.ReadCloser, error) {
+	path, err := d.Path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Open(path)
+}
+
+// Delete removes the file stored under key. Deleting a missing key is
+// not an error.
+func (d *DiskUploadStore) Delete(key string) error {
+	path, err := d.Path(key)
+	if err != nil {
+		return err
+	}
+
+	if err = os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,561 @@
+package compass
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// websocketGUID is the magic value from RFC 6455 used to compute
+// Sec-WebSocket-Accept.
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// frameChunkSize is how much of a frame payload is allocated at a time
+// while reading it, see readPayload.
+const frameChunkSize = 64 << 10
+
+// WebSocket message types, matching the frame opcodes of RFC 6455.
+const (
+	TextMessage   = 1
+	BinaryMessage = 2
+	CloseMessage  = 8
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// WebSocket close codes used by the framework.
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseInvalidPayload  = 1007
+	ClosePolicyViolation = 1008
+	CloseMessageTooBig   = 1009
+)
+
+var (
+	// ErrMessageTooLarge is returned by Conn.ReadMessage if a message
+	// exceeds WebSocketOptions.MaxMessageSize.
+	ErrMessageTooLarge = errors.New("websocket message exceeds the allowed size")
+
+	// ErrConnClosed is returned when writing to a closed Conn.
+	ErrConnClosed = errors.New("websocket connection is closed")
+)
+
+// CloseError is returned by Conn.ReadMessage when the peer closed the
+// connection.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed with code %d: %s", e.Code, e.Reason)
+}
+
+// WebSocketOptions configures a WebSocket endpoint.
+type WebSocketOptions struct {
+	// MaxMessageSize is the maximum size of a reassembled message in bytes.
+	// Zero means no limit. Memory is only allocated as the data arrives,
+	// but without a limit a client can still send as much as it likes.
+	MaxMessageSize int64
+
+	// Subprotocols lists the supported subprotocols in order of preference.
+	Subprotocols []string
+
+	// CheckOrigin decides whether the Origin of the handshake is accepted.
+	// Defaults to SameOrigin if nil.
+	CheckOrigin func(request Request) bool
+
+	// RequireSession rejects handshakes without a valid session with 401.
+	RequireSession bool
+}
+
+// DefaultWebSocketOptions returns the options used by AddWebSocket: a
+// 1MB message limit and same-origin checking.
+func DefaultWebSocketOptions() WebSocketOptions {
+	return WebSocketOptions{
+		MaxMessageSize: 1 << 20,
+		CheckOrigin:    SameOrigin,
+	}
+}
+
+// SameOrigin accepts handshakes without an Origin header (non-browser
+// clients) and handshakes whose Origin host matches the request's host.
+func SameOrigin(request Request) bool {
+	origin := request.Http.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+
+	return strings.EqualFold(u.Host, request.Host())
+}
+
+// AddWebSocket registers a WebSocket endpoint using DefaultWebSocketOptions.
+//
+// The handler is called after a successful handshake and owns the
+// connection until it returns, after which the connection is closed. The
+// Request is the one of the handshake, so cookies and sessions work:
+//
+//	server.AddWebSocket("/ws", func(request compass.Request, conn *compass.Conn) {
+//		session, ok := request.GetSession(server)
+//		...
+//	})
+func (s *Server) AddWebSocket(path string, handler func(request Request, conn *Conn)) *Route {
+	return s.AddWebSocketWithOptions(path, DefaultWebSocketOptions(), handler)
+}
+
+// AddWebSocketWithOptions registers a WebSocket endpoint with custom options.
+func (s *Server) AddWebSocketWithOptions(path string, opts WebSocketOptions, handler func(request Request, conn *Conn)) *Route {
+	return s.AddRoute(path, func(request Request) Response {
+		return UpgradeWebSocket(request, opts, func(conn *Conn) {
+			handler(request, conn)
+		})
+	})
+}
+
+// UpgradeWebSocket validates a WebSocket handshake and returns a response
+// that takes over the connection and calls fn with it.
+//
+// If the handshake is invalid, a normal error response is returned instead
+// (400, 401, 403 or 426), so this can also be used inside regular handlers.
+func UpgradeWebSocket(request Request, opts WebSocketOptions, fn func(conn *Conn)) Response {
+	header := request.Http.Header
+
+	if request.Method != "get" ||
+		!headerHasToken(header, "Connection", "upgrade") ||
+		!headerHasToken(header, "Upgrade", "websocket") {
+		return TextWithCode("Expected a WebSocket handshake", http.StatusBadRequest)
+	}
+
+	if header.Get("Sec-WebSocket-Version") != "13" {
+		resp := TextWithCode("Unsupported WebSocket version", http.StatusUpgradeRequired)
+		resp.Headers.Set("Sec-WebSocket-Version", "13")
+		return resp
+	}
+
+	key := header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return TextWithCode("Invalid Sec-WebSocket-Key", http.StatusBadRequest)
+	}
+
+	checkOrigin := opts.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+
+	if !checkOrigin(request) {
+		return TextWithCode("Origin not allowed", http.StatusForbidden)
+	}
+
+	if opts.RequireSession {
+		if request.server == nil {
+			return TextWithCode("Unauthorized", http.StatusUnauthorized)
+		}
+
+		if _, ok := request.GetSession(request.server); !ok {
+			return TextWithCode("Unauthorized", http.StatusUnauthorized)
+		}
+	}
+
+	subprotocol := ""
+	for _, offered := range splitHeaderList(header.Values("Sec-WebSocket-Protocol")) {
+		if slices.Contains(opts.Subprotocols, offered) {
+			subprotocol = offered
+			break
+		}
+	}
+
+	resp := Raw(nil, nil, http.StatusSwitchingProtocols)
+	resp.kind = KindUpgrade
+	resp.stream = func(w http.ResponseWriter, r *http.Request) error {
+		// Headers and cookies set on the response, e.g. by the
+		// Postprocessor, go into the handshake. The ones the handshake
+		// writes itself are left out.
+		extra := w.Header().Clone()
+		for _, key := range []string{"Upgrade", "Connection", "Sec-WebSocket-Accept", "Sec-WebSocket-Protocol", "Content-Length", "Content-Type", "Transfer-Encoding"} {
+			extra.Del(key)
+		}
+
+		netConn, rw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return fmt.Errorf("failed to hijack connection for websocket: %w", err)
+		}
+
+		conn := &Conn{
+			conn:           netConn,
+			reader:         rw.Reader,
+			maxMessageSize: opts.MaxMessageSize,
+			Subprotocol:    subprotocol,
+		}
+		defer conn.finish()
+
+		netConn.SetDeadline(time.Time{})
+
+		var b strings.Builder
+		b.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+		b.WriteString("Upgrade: websocket\r\n")
+		b.WriteString("Connection: Upgrade\r\n")
+		fmt.Fprintf(&b, "Sec-WebSocket-Accept: %s\r\n", websocketAccept(key))
+		if subprotocol != "" {
+			fmt.Fprintf(&b, "Sec-WebSocket-Protocol: %s\r\n", subprotocol)
+		}
+		extra.Write(&b)
+		b.WriteString("\r\n")
+
+		if _, err = netConn.Write([]byte(b.String())); err != nil {
+			return fmt.Errorf("failed to write websocket handshake: %w", err)
+		}
+
+		fn(conn)
+		return nil
+	}
+
+	return resp
+}
+
+// websocketAccept computes the Sec-WebSocket-Accept value for a key.
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// headerHasToken reports whether a comma-separated header contains the
+// token, compared case-insensitively.
+func headerHasToken(header http.Header, name string, token string) bool {
+	for _, value := range splitHeaderList(header.Values(name)) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//
+// Conn
+//
+
+// Conn is a server side WebSocket connection.
+//
+// ReadMessage must only be called from one goroutine at a time. Writes
+// are serialised internally, so they can come from any goroutine.
+type Conn struct {
+	conn           net.Conn
+	reader         *bufio.Reader
+	maxMessageSize int64
+
+	// Subprotocol is the negotiated subprotocol, or empty if none.
+	Subprotocol string
+
+	// OnPong is called with the payload of every pong received.
+	OnPong func(data []byte)
+
+	writeMutex sync.Mutex
+	closeSent  bool
+}
+
+// ReadMessage reads the next text or binary message.
+//
+// Pings are answered automatically and pongs are passed to OnPong. If the
+// peer closes the connection, the close is acknowledged and a *CloseError
+// is returned. Protocol violations close the connection with the matching
+// close code and return an error.
+func (c *Conn) ReadMessage() (int, []byte, error) {
+	messageType := 0
+	message := make([]byte, 0)
+
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch opcode {
+		case PingMessage:
+			if err = c.WriteMessage(PongMessage, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case PongMessage:
+			if c.OnPong != nil {
+				c.OnPong(payload)
+			}
+			continue
+		case CloseMessage:
+			return 0, nil, c.handleClose(payload)
+		case 0:
+			if messageType == 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		case TextMessage, BinaryMessage:
+			if messageType != 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected continuation frame")
+			}
+			messageType = opcode
+		default:
+			return 0, nil, c.fail(CloseProtocolError, fmt.Sprintf("unknown opcode %d", opcode))
+		}
+
+		if c.maxMessageSize > 0 && int64(len(message)+len(payload)) > c.maxMessageSize {
+			c.fail(CloseMessageTooBig, "message too big")
+			return 0, nil, ErrMessageTooLarge
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		if messageType == TextMessage && !utf8.Valid(message) {
+			return 0, nil, c.fail(CloseInvalidPayload, "invalid utf-8")
+		}
+
+		return messageType, message, nil
+	}
+}
+
+// readFrame reads and unmasks a single frame.
+func (c *Conn) readFrame() (bool, int, []byte, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(c.reader, head); err != nil {
+		return false, 0, nil, err
+	}
+
+	fin := head[0]&0x80 != 0
+	opcode := int(head[0] & 0x0f)
+	masked := head[1]&0x80 != 0
+	length := uint64(head[1] & 0x7f)
+
+	if head[0]&0x70 != 0 {
+		return false, 0, nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+
+	if !masked {
+		return false, 0, nil, c.fail(CloseProtocolError, "client frames must be masked")
+	}
+
+	if opcode >= CloseMessage && (!fin || length > 125) {
+		return false, 0, nil, c.fail(CloseProtocolError, "invalid control frame")
+	}
+
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(c.reader, ext); err != nil {
+			return false, 0, nil, err
+		}
+		length = binary.BigEndian.Uint64(ext)
+		if length&(1<<63) != 0 {
+			return false, 0, nil, c.fail(CloseProtocolError, "invalid payload length")
+		}
+	}
+
+	// check before allocating, so a huge length can't exhaust memory
+	if c.maxMessageSize > 0 && length > uint64(c.maxMessageSize) {
+		c.fail(CloseMessageTooBig, "message too big")
+		return false, 0, nil, ErrMessageTooLarge
+	}
+
+	mask := make([]byte, 4)
+	if _, err := io.ReadFull(c.reader, mask); err != nil {
+		return false, 0, nil, err
+	}
+
+	payload, err := readPayload(c.reader, length)
+	if err != nil {
+		return false, 0, nil, err
+	}
+
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+
+	return fin, opcode, payload, nil
+}
+
+// readPayload reads a frame payload of the given length. The length comes
+// from the client, so the buffer grows by at most frameChunkSize ahead of
+// the data that actually arrived. Without MaxMessageSize, a header claiming
+// a huge payload would otherwise allocate it up front.
+func readPayload(r io.Reader, length uint64) ([]byte, error) {
+	payload := make([]byte, 0, min(length, frameChunkSize))
+	for uint64(len(payload)) < length {
+		start := len(payload)
+		n := int(min(length-uint64(start), frameChunkSize))
+
+		payload = slices.Grow(payload, n)[:start+n]
+		if _, err := io.ReadFull(r, payload[start:]); err != nil {
+			return nil, err
+		}
+	}
+
+	return payload, nil
+}
+
+// handleClose acknowledges a close frame from the peer and returns the
+// matching CloseError.
+func (c *Conn) handleClose(payload []byte) error {
+	closeErr := &CloseError{Code: CloseNoStatus}
+
+	if len(payload) >= 2 {
+		closeErr.Code = int(binary.BigEndian.Uint16(payload))
+		closeErr.Reason = string(payload[2:])
+	}
+
+	if len(payload) == 1 || !utf8.ValidString(closeErr.Reason) {
+		c.fail(CloseProtocolError, "invalid close frame")
+		return closeErr
+	}
+
+	if closeErr.Code == CloseNoStatus {
+		c.writeClose(nil)
+	} else {
+		c.writeClose(payload[:2])
+	}
+
+	return closeErr
+}
+
+// fail closes the connection with a code and reason and returns an error
+// describing the violation.
+func (c *Conn) fail(code int, reason string) error {
+	c.CloseWithCode(code, reason)
+	return fmt.Errorf("websocket protocol error: %s", reason)
+}
+
+// WriteMessage writes a single unfragmented frame.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	if c.closeSent {
+		return ErrConnClosed
+	}
+
+	if messageType == CloseMessage {
+		c.closeSent = true
+	}
+
+	return c.writeFrame(messageType, data)
+}
+
+// writeFrame writes an unmasked frame. The write mutex must be held.
+func (c *Conn) writeFrame(opcode int, data []byte) error {
+	frame := make([]byte, 0, len(data)+10)
+	frame = append(frame, 0x80|byte(opcode))
+
+	switch {
+	case len(data) <= 125:
+		frame = append(frame, byte(len(data)))
+	case len(data) <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(data)))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(data)))
+	}
+
+	frame = append(frame, data...)
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// WriteText writes a text message.
+func (c *Conn) WriteText(text string) error {
+	return c.WriteMessage(TextMessage, []byte(text))
+}
+
+// WriteBinary writes a binary message.
+func (c *Conn) WriteBinary(data []byte) error {
+	return c.WriteMessage(BinaryMessage, data)
+}
+
+// Ping sends a ping. The answer is passed to OnPong.
+func (c *Conn) Ping(data []byte) error {
+	return c.WriteMessage(PingMessage, data)
+}
+
+// writeClose sends a close frame with a raw payload, unless one was sent
+// already.
+func (c *Conn) writeClose(payload []byte) {
+	c.WriteMessage(CloseMessage, payload)
+}
+
+// CloseWithCode sends a close frame with the given code and reason. The
+// connection itself is closed once the handler returns.
+//
+// Control frames carry at most 125 bytes, so a longer reason is cut at the
+// last rune that fits. The peer rejects a reason that isn't valid UTF-8.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	// The code takes 2 of the 125 bytes.
+	if len(reason) > 123 {
+		n := 123
+		for n > 0 && !utf8.RuneStart(reason[n]) {
+			n--
+		}
+		reason = reason[:n]
+	}
+
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	payload = append(payload, reason...)
+
+	err := c.WriteMessage(CloseMessage, payload)
+	if errors.Is(err, ErrConnClosed) {
+		return nil
+	}
+
+	return err
+}
+
+// Close sends a normal close frame.
+func (c *Conn) Close() error {
+	return c.CloseWithCode(CloseNormal, "")
+}
+
+// SetReadDeadline sets the deadline for reads on the underlying connection.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	return c.conn.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes on the underlying connection.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	return c.conn.SetWriteDeadline(t)
+}
+
+// RemoteAddr returns the address of the direct peer.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+// finish closes the connection after the handler returned. A normal close
+// frame is sent first if the handler did not close the connection.
+func (c *Conn) finish() {
+	c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+	c.Close()
+	c.conn.Close()
+}
@@ -0,0 +1,53 @@
+package compass
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCloseWithCodeTruncatesAtRuneBoundary(t *testing.T) {
+	for pad := range 3 {
+		reason := strings.Repeat("a", pad) + strings.Repeat("€", 60)
+
+		server, client := net.Pipe()
+		conn := &Conn{conn: server}
+
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.CloseWithCode(ClosePolicyViolation, reason)
+		}()
+
+		header := make([]byte, 2)
+		if _, err := io.ReadFull(client, header); err != nil {
+			t.Fatal(err)
+		}
+
+		payload := make([]byte, header[1]&0x7f)
+		if _, err := io.ReadFull(client, payload); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := <-done; err != nil {
+			t.Fatal(err)
+		}
+		server.Close()
+		client.Close()
+
+		if len(payload) > 125 {
+			t.Fatalf("payload is %d bytes, want at most 125", len(payload))
+		}
+
+		if code := binary.BigEndian.Uint16(payload); code != ClosePolicyViolation {
+			t.Fatalf("code = %d, want %d", code, ClosePolicyViolation)
+		}
+
+		got := string(payload[2:])
+		if !utf8.ValidString(got) || !strings.HasPrefix(reason, got) || len(got) < 121 {
+			t.Fatalf("reason with %d bytes of padding cut to %q", pad, got)
+		}
+	}
+}